@@ -19,10 +19,20 @@ replace (
 )
 
 require (
+	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/gin-gonic/gin v1.4.0
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
-	github.com/gorilla/websocket v1.4.0 // indirect
+	github.com/golang/protobuf v1.3.1 // indirect
+	github.com/gorilla/websocket v1.4.0
 	github.com/igm/sockjs-go v2.0.0+incompatible // indirect
-	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/pkg/sftp v1.11.0
+	github.com/prometheus/client_golang v0.9.0
+	github.com/prometheus/client_model v0.0.0-20170216185247-6f3806018612 // indirect
+	github.com/prometheus/common v0.0.0-20181126121408-4724e9255275 // indirect
+	github.com/prometheus/procfs v0.0.0-20181204211112-1dc9a6cbc91a // indirect
+	golang.org/x/crypto v0.0.0-20190820162420-60c769a6c586
 	gopkg.in/igm/sockjs-go.v2 v2.0.0
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"web-terminal/internal"
+)
+
+// runImport implements `web-terminal import [-inventory inventory.json] [-format ssh_config|ansible|ansible-yaml] [-dry-run] <file>`,
+// it merges an ssh_config or Ansible inventory into the host inventory, prints the diff and returns the exit code
+func runImport(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	inventoryFile := flags.String("inventory", "inventory.json", "the host inventory to import into")
+	format := flags.String("format", "", "ssh_config, ansible or ansible-yaml, guessed from the file when empty")
+	dryRun := flags.Bool("dry-run", false, "only print what would change")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: web-terminal import [flags] <file>")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	content, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *format == "" {
+		*format = internal.DetectImportFormat(flags.Arg(0), content)
+	}
+	if err := internal.InitInventory(*inventoryFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	result, err := internal.ImportInventory(*format, content, *dryRun)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	marks := map[string]string{internal.ImportAdd: "+", internal.ImportUpdate: "~", internal.ImportUnchanged: "="}
+	changed := 0
+	for _, g := range result.Groups {
+		fmt.Printf("%s group %s\n", marks[g.Action], g.Name)
+		printChanges(g.Changes)
+		if g.Action != internal.ImportUnchanged {
+			changed++
+		}
+	}
+	for _, h := range result.Hosts {
+		fmt.Printf("%s host %s (%s)\n", marks[h.Action], h.Name, h.Host.Address)
+		printChanges(h.Changes)
+		if h.Action != internal.ImportUnchanged {
+			changed++
+		}
+	}
+	for _, warning := range result.Warnings {
+		fmt.Fprintln(os.Stderr, "warning:", warning)
+	}
+	if *dryRun {
+		fmt.Printf("dry run, %d change(s) not written to %s\n", changed, *inventoryFile)
+	} else {
+		fmt.Printf("%d change(s) written to %s\n", changed, *inventoryFile)
+	}
+	return 0
+}
+
+func printChanges(changes []string) {
+	if len(changes) > 0 {
+		fmt.Println("    " + strings.Join(changes, "\n    "))
+	}
+}
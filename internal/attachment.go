@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// AttachRole decides what a connection attached to a terminal is allowed to do
+type AttachRole string
+
+const (
+	// RoleOwner is the connection of whoever created the terminal
+	RoleOwner AttachRole = "owner"
+	// RoleWriter can type into the terminal like the owner
+	RoleWriter AttachRole = "writer"
+	// RoleReadOnly only watches, its stdin, resize and signal messages are dropped
+	RoleReadOnly AttachRole = "readonly"
+)
+
+// ParseShareRole validates the role requested for a share link, owner can't be shared
+func ParseShareRole(role string) (AttachRole, error) {
+	switch r := AttachRole(role); r {
+	case RoleWriter, RoleReadOnly:
+		return r, nil
+	case "":
+		return RoleReadOnly, nil
+	default:
+		return "", fmt.Errorf("unknown share role '%s', expected writer or readonly", role)
+	}
+}
+
+// attachment is one SockJS or WebSocket connection attached to a TerminalSession
+type attachment struct {
+	conn       terminalConn
+	role       AttachRole
+	attachedAt time.Time
+}
+
+func (a *attachment) canWrite() bool {
+	return a.role == RoleOwner || a.role == RoleWriter
+}
+
+// attach adds conn to the connections of the terminal, replaying the scrollback to it if
+// the terminal already produced output
+func (t *TerminalSession) attach(conn terminalConn, role AttachRole) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	select {
+	case <-t.done:
+		return fmt.Errorf("session '%s' is closed", t.id)
+	default:
+	}
+	if history := t.scrollback.Bytes(); len(history) > 0 {
+		if err := conn.SendStdout(trimPartialRune(history)); err != nil {
+			return err
+		}
+	}
+	a := &attachment{conn: conn, role: role, attachedAt: time.Now()}
+	t.attachments[conn.ID()] = a
+	connectionsTotal.WithLabelValues(conn.Transport()).Inc()
+	t.detachedAt = time.Time{}
+	go t.pump(a)
+	return nil
+}
+
+// detach forgets a connection, the terminal is detached once the last one is gone
+func (t *TerminalSession) detach(a *attachment) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.detachLocked(a)
+}
+
+func (t *TerminalSession) detachLocked(a *attachment) {
+	if t.attachments[a.conn.ID()] != a {
+		return
+	}
+	_ = a.conn.Close(closeLost, "Connection lost")
+	delete(t.attachments, a.conn.ID())
+	if t.transfer != nil && t.transfer.conn == a.conn.ID() {
+		t.endTransferLocked(true, "")
+	}
+	if len(t.attachments) == 0 {
+		t.detachedAt = time.Now()
+	}
+}
+
+// broadcastLocked calls send for every attached connection, dropping the ones that fail
+func (t *TerminalSession) broadcastLocked(send func(conn terminalConn) error) {
+	for _, a := range t.attachments {
+		if err := send(a.conn); err != nil {
+			t.detachLocked(a)
+		}
+	}
+}
+
+// detachedSince returns when the terminal lost its last connection, zero while attached
+func (t *TerminalSession) detachedSince() time.Time {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.detachedAt
+}
+
+// pump receives the messages (stdin, resize, signal, transfer) of one connection until it is lost,
+// messages of read-only connections are dropped
+func (t *TerminalSession) pump(a *attachment) {
+	defer recoverSession(t.id)
+	for {
+		msg, err := a.conn.Recv()
+		if err != nil {
+			t.detach(a)
+			return
+		}
+		if !a.canWrite() {
+			continue
+		}
+		t.touch()
+
+		switch msg.Op {
+		case "stdin":
+			t.lock.Lock()
+			t.lastInput = a.conn.ID()
+			t.lock.Unlock()
+			select {
+			case t.input <- []byte(msg.Data):
+			case <-t.done:
+				return
+			}
+		case "resize":
+			select {
+			case t.sizeChan <- &TerminalSize{Width: msg.Cols, Height: msg.Rows}:
+			case <-t.done:
+				return
+			}
+		case "transfer", "transfer_end":
+			if err := t.transferInput(a, msg); err != nil {
+				_ = a.conn.SendMessage(TerminalMessage{Op: "toast", Data: err.Error()})
+			}
+		case "signal":
+			if err := t.Signal(msg.Signal); err != nil {
+				_ = a.conn.SendMessage(TerminalMessage{Op: "toast", Data: err.Error()})
+			}
+		default:
+			log.Printf("pump: unknown message type '%s'", msg.Op)
+		}
+	}
+}
+
+// share mints a token other connections can bind with to join the terminal as role
+func (t *TerminalSession) share(role AttachRole) (string, error) {
+	token, err := genTerminalSessionId()
+	if err != nil {
+		return "", err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.shares[token] = role
+	return token, nil
+}
+
+func (t *TerminalSession) shareRole(token string) (AttachRole, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	role, ok := t.shares[token]
+	if !ok {
+		return "", fmt.Errorf("invalid share token for session '%s'", t.id)
+	}
+	return role, nil
+}
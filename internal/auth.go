@@ -0,0 +1,252 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// principalKey is the gin context key of the authenticated principal
+const principalKey = "principal"
+
+// Principal is whoever is calling the API
+type Principal struct {
+	Name  string `json:"name"`
+	Admin bool   `json:"admin"`
+}
+
+// anonymous is used for every request when no authenticator is configured
+var anonymous = &Principal{Name: "anonymous", Admin: true}
+
+// nobody is the principal of a request that didn't go through Authenticate, it owns nothing and
+// isn't an administrator
+var nobody = &Principal{}
+
+// Authenticator turns a bearer token into a principal
+type Authenticator interface {
+	Authenticate(token string) (*Principal, error)
+}
+
+var errUnknownToken = errors.New("unknown token")
+
+var authenticators []Authenticator
+
+// UseAuthenticator is called from main to enable an authentication method, the methods are
+// tried in the order they were added. Without any authenticator the API is open.
+func UseAuthenticator(a Authenticator) {
+	authenticators = append(authenticators, a)
+}
+
+// AuthEnabled reports whether any authenticator has been configured
+func AuthEnabled() bool {
+	return len(authenticators) > 0
+}
+
+// StaticTokenAuthenticator accepts a fixed set of API tokens
+type StaticTokenAuthenticator struct {
+	tokens map[string]Principal
+}
+
+// NewStaticTokenAuthenticator loads the tokens of a file, one `<token> <principal> [admin]` per line,
+// lines starting with # are comments
+func NewStaticTokenAuthenticator(path string) (*StaticTokenAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := &StaticTokenAuthenticator{tokens: make(map[string]Principal)}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 || (len(fields) == 3 && fields[2] != "admin") {
+			return nil, fmt.Errorf("%s:%d: expected '<token> <principal> [admin]'", path, n)
+		}
+		a.tokens[fields[0]] = Principal{Name: fields[1], Admin: len(fields) == 3}
+	}
+	return a, scanner.Err()
+}
+
+func (a *StaticTokenAuthenticator) Authenticate(token string) (*Principal, error) {
+	for known, principal := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(token)) == 1 {
+			p := principal
+			return &p, nil
+		}
+	}
+	return nil, errUnknownToken
+}
+
+// JWTAuthenticator accepts HS256 signed JWTs, the principal is the "sub" claim and an
+// "admin": true claim or "admin" in "roles" makes it an administrator
+type JWTAuthenticator struct {
+	secret []byte
+}
+
+func NewJWTAuthenticator(secret string) *JWTAuthenticator {
+	return &JWTAuthenticator{secret: []byte(secret)}
+}
+
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	Admin     bool     `json:"admin"`
+	Roles     []string `json:"roles"`
+}
+
+func (a *JWTAuthenticator) Authenticate(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errUnknownToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "HS256" {
+		return nil, fmt.Errorf("jwt: unsupported algorithm '%s'", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("jwt: malformed signature: %v", err)
+	}
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("jwt: invalid signature")
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	if claims.ExpiresAt != 0 && now >= claims.ExpiresAt {
+		return nil, errors.New("jwt: token is expired")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, errors.New("jwt: token is not valid yet")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("jwt: missing sub claim")
+	}
+	principal := &Principal{Name: claims.Subject, Admin: claims.Admin}
+	for _, role := range claims.Roles {
+		if role == "admin" {
+			principal.Admin = true
+		}
+	}
+	return principal, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	content, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("jwt: malformed token: %v", err)
+	}
+	if err := json.Unmarshal(content, v); err != nil {
+		return fmt.Errorf("jwt: malformed token: %v", err)
+	}
+	return nil
+}
+
+// requestToken reads the bearer token of a request, browsers can't set headers on SockJS and
+// WebSocket connections so the access_token query parameter is accepted too
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// HideAccessToken moves the access_token query parameter into the Authorization header before the
+// request is logged, the access log would otherwise keep every token passed in a URL
+func HideAccessToken() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		r := context.Request
+		query := r.URL.Query()
+		if token := query.Get("access_token"); token != "" {
+			if r.Header.Get("Authorization") == "" {
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+			query.Del("access_token")
+			r.URL.RawQuery = query.Encode()
+			r.RequestURI = r.URL.RequestURI()
+		}
+		context.Next()
+	}
+}
+
+func authenticate(token string) (*Principal, error) {
+	if !AuthEnabled() {
+		return anonymous, nil
+	}
+	if token == "" {
+		return nil, errors.New("missing bearer token")
+	}
+	err := errUnknownToken
+	for _, a := range authenticators {
+		var principal *Principal
+		if principal, err = a.Authenticate(token); err == nil {
+			return principal, nil
+		}
+	}
+	return nil, err
+}
+
+// Authenticate is the gin middleware guarding the API, it stores the principal in the context
+func Authenticate() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		principal, err := authenticate(requestToken(context.Request))
+		if err != nil {
+			context.AbortWithStatusJSON(http.StatusUnauthorized, err.Error())
+			return
+		}
+		context.Set(principalKey, principal)
+		context.Next()
+	}
+}
+
+// RequireAdmin only lets administrators through, it must come after Authenticate
+func RequireAdmin() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if !CurrentPrincipal(context).Admin {
+			context.AbortWithStatusJSON(http.StatusForbidden, http.StatusText(http.StatusForbidden))
+			return
+		}
+		context.Next()
+	}
+}
+
+// CurrentPrincipal returns the principal stored by Authenticate, nobody when the handler isn't
+// mounted behind it
+func CurrentPrincipal(context *gin.Context) *Principal {
+	if principal, ok := context.Get(principalKey); ok {
+		return principal.(*Principal)
+	}
+	return nobody
+}
+
+// allowed reports whether p may act on something owned by owner
+func (p *Principal) allowed(owner string) bool {
+	return p.Admin || (p.Name != "" && p.Name == owner)
+}
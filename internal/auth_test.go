@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func signJWT(secret, header, claims string) string {
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	const hs256 = `{"alg":"HS256","typ":"JWT"}`
+	now := time.Now().Unix()
+	claims := func(extra string) string { return `{"sub":"alice"` + extra + `}` }
+	exp := func(offset int64) string { return `,"exp":` + strconv.FormatInt(now+offset, 10) }
+	nbf := func(offset int64) string { return `,"nbf":` + strconv.FormatInt(now+offset, 10) }
+
+	tests := []struct {
+		name  string
+		token string
+		want  *Principal // nil when the token must be refused
+	}{
+		{"valid", signJWT("s", hs256, claims("")), &Principal{Name: "alice"}},
+		{"admin claim", signJWT("s", hs256, claims(`,"admin":true`)), &Principal{Name: "alice", Admin: true}},
+		{"admin role", signJWT("s", hs256, claims(`,"roles":["dev","admin"]`)), &Principal{Name: "alice", Admin: true}},
+		{"other roles", signJWT("s", hs256, claims(`,"roles":["dev"]`)), &Principal{Name: "alice"}},
+		{"not expired", signJWT("s", hs256, claims(exp(60))), &Principal{Name: "alice"}},
+		{"expired", signJWT("s", hs256, claims(exp(-60))), nil},
+		{"expires now", signJWT("s", hs256, claims(exp(0))), nil},
+		{"not valid yet", signJWT("s", hs256, claims(nbf(60))), nil},
+		{"valid since", signJWT("s", hs256, claims(nbf(-60))), &Principal{Name: "alice"}},
+		{"wrong secret", signJWT("other", hs256, claims("")), nil},
+		{"alg none", signJWT("s", `{"alg":"none"}`, claims("")), nil},
+		{"alg HS512", signJWT("s", `{"alg":"HS512"}`, claims("")), nil},
+		{"missing sub", signJWT("s", hs256, `{"admin":true}`), nil},
+		{"two parts", "a.b", nil},
+		{"garbage", "x.y.z", nil},
+		{"empty", "", nil},
+	}
+	a := NewJWTAuthenticator("s")
+	for _, tt := range tests {
+		got, err := a.Authenticate(tt.token)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: accepted as %+v, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if *got != *tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestJWTAuthenticatorTamperedClaims(t *testing.T) {
+	parts := strings.Split(signJWT("s", `{"alg":"HS256"}`, `{"sub":"alice"}`), ".")
+	parts[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"alice","admin":true}`))
+	if _, err := NewJWTAuthenticator("s").Authenticate(strings.Join(parts, ".")); err == nil {
+		t.Fatal("accepted a token whose claims were changed after signing")
+	}
+}
+
+func TestStaticTokenAuthenticator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens")
+	content := "# token principal [admin]\n\nt1 alice\nt2 root admin\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewStaticTokenAuthenticator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for token, want := range map[string]Principal{"t1": {Name: "alice"}, "t2": {Name: "root", Admin: true}} {
+		if got, err := a.Authenticate(token); err != nil || *got != want {
+			t.Errorf("%s: got %+v, %v, want %+v", token, got, err, want)
+		}
+	}
+	for _, token := range []string{"", "t3", "alice"} {
+		if _, err := a.Authenticate(token); err == nil {
+			t.Errorf("%q: accepted", token)
+		}
+	}
+
+	for _, bad := range []string{"t1\n", "t1 alice owner\n", "t1 alice admin extra\n"} {
+		if err := ioutil.WriteFile(path, []byte(bad), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewStaticTokenAuthenticator(path); err == nil {
+			t.Errorf("%q: loaded", bad)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(old []Authenticator) { authenticators = old }(authenticators)
+	authenticators = []Authenticator{&StaticTokenAuthenticator{tokens: map[string]Principal{"t1": {Name: "alice"}}}}
+
+	tests := []struct {
+		url, auth string
+		status    int
+	}{
+		{"/v1/terminal", "Bearer t1", 200},
+		{"/v1/terminal?access_token=t1", "", 200},
+		{"/v1/terminal", "", 401},
+		{"/v1/terminal", "Bearer t2", 401},
+		{"/v1/terminal?access_token=t2", "", 401},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		context, _ := gin.CreateTestContext(recorder)
+		context.Request = httptest.NewRequest("GET", tt.url, nil)
+		if tt.auth != "" {
+			context.Request.Header.Set("Authorization", tt.auth)
+		}
+		Authenticate()(context)
+		if context.IsAborted() != (tt.status != 200) || (tt.status != 200 && recorder.Code != tt.status) {
+			t.Errorf("%s %q: aborted %v with %d, want %d", tt.url, tt.auth, context.IsAborted(), recorder.Code, tt.status)
+			continue
+		}
+		if tt.status == 200 && CurrentPrincipal(context).Name != "alice" {
+			t.Errorf("%s %q: got principal %+v", tt.url, tt.auth, CurrentPrincipal(context))
+		}
+	}
+}
+
+func TestHideAccessToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		url, auth           string
+		wantQuery, wantAuth string
+	}{
+		{"/v1/ws?access_token=t1&x=1", "", "x=1", "Bearer t1"},
+		{"/v1/ws?access_token=t1", "Bearer t2", "", "Bearer t2"},
+		{"/v1/ws?x=1", "", "x=1", ""},
+	}
+	for _, tt := range tests {
+		context, _ := gin.CreateTestContext(httptest.NewRecorder())
+		context.Request = httptest.NewRequest("GET", tt.url, nil)
+		if tt.auth != "" {
+			context.Request.Header.Set("Authorization", tt.auth)
+		}
+		HideAccessToken()(context)
+		if got := context.Request.URL.RawQuery; got != tt.wantQuery {
+			t.Errorf("%s: query %q, want %q", tt.url, got, tt.wantQuery)
+		}
+		if got := context.Request.Header.Get("Authorization"); got != tt.wantAuth {
+			t.Errorf("%s: Authorization %q, want %q", tt.url, got, tt.wantAuth)
+		}
+	}
+}
+
+func TestCurrentPrincipalWithoutAuthenticate(t *testing.T) {
+	context, _ := gin.CreateTestContext(httptest.NewRecorder())
+	p := CurrentPrincipal(context)
+	if p.Admin {
+		t.Fatal("a request that didn't go through Authenticate is an administrator")
+	}
+	if p.allowed("") || p.allowed("alice") {
+		t.Fatal("a request that didn't go through Authenticate owns something")
+	}
+}
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"runtime/debug"
+
+	"github.com/golang/glog"
+	"golang.org/x/crypto/ssh"
+)
+
+// ExitReason tells the browser why a terminal was closed
+type ExitReason string
+
+const (
+	ExitProcessExited    ExitReason = "process_exited"
+	ExitAuthFailed       ExitReason = "auth_failed"
+	ExitHostUnreachable  ExitReason = "host_unreachable"
+	ExitHostKeyMismatch  ExitReason = "host_key_mismatch"
+	ExitHostKeyUnknown   ExitReason = "host_key_unknown"
+	ExitTargetBlocked    ExitReason = "target_blocked"
+	ExitBindTimeout      ExitReason = "bind_timeout"
+	ExitReconnectTimeout ExitReason = "reconnect_timeout"
+	ExitIdleTimeout      ExitReason = "idle_timeout"
+	ExitKilledByAdmin    ExitReason = "killed_by_admin"
+	ExitStatusMissing    ExitReason = "exit_status_missing"
+	ExitConnectionLost   ExitReason = "connection_lost"
+	ExitKeepaliveTimeout ExitReason = "keepalive_timeout"
+	ExitError            ExitReason = "error"
+)
+
+// Close status of the connections, also the WebSocket close code minus 4000
+const (
+	closeProcessExited uint32 = 1
+	closeError         uint32 = 2
+	closeReaped        uint32 = 3
+	closeLost          uint32 = 4 // the connection was dropped, the terminal keeps running
+)
+
+// TerminalExit is sent to every connection as an exit message right before a terminal is closed
+type TerminalExit struct {
+	Status  uint32 // close status of the connections
+	Reason  ExitReason
+	Code    int    // exit status of the remote process
+	Signal  string // signal that killed the remote process, e.g. "KILL"
+	Message string // shown to the user, also the close reason
+}
+
+func (e TerminalExit) message() TerminalMessage {
+	return TerminalMessage{Op: "exit", Data: e.Message, Reason: string(e.Reason), ExitCode: e.Code, Signal: e.Signal}
+}
+
+// processExit describes how the remote shell ended, err is what ssh.Session.Wait returned. A
+// non-zero exit status is a normal end of the process, not an error.
+func processExit(err error) TerminalExit {
+	exit := TerminalExit{Status: closeProcessExited, Reason: ExitProcessExited, Message: "Process exited"}
+	switch e := err.(type) {
+	case nil:
+	case *ssh.ExitError:
+		exit.Code, exit.Signal = e.ExitStatus(), e.Signal()
+		if exit.Signal != "" {
+			exit.Message = fmt.Sprintf("Process was killed by signal %s", exit.Signal)
+		} else {
+			exit.Message = fmt.Sprintf("Process exited with status %d", exit.Code)
+		}
+	case *ssh.ExitMissingError:
+		exit.Status, exit.Reason = closeError, ExitStatusMissing
+		exit.Message = "Process ended without an exit status, the connection was probably lost"
+	default:
+		exit = errorExit(err)
+	}
+	return exit
+}
+
+// isNetworkError reports whether err comes from the connection rather than from ssh itself
+func isNetworkError(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// errorExit classifies an error that ended a terminal
+func errorExit(err error) TerminalExit {
+	exit := TerminalExit{Status: closeError, Reason: ExitError, Message: err.Error()}
+	switch err.(type) {
+	case *AuthError:
+		exit.Reason = ExitAuthFailed
+	case *UnreachableError:
+		exit.Reason = ExitHostUnreachable
+	case *HostKeyChangedError:
+		exit.Reason = ExitHostKeyMismatch
+	case *HostKeyUnknownError:
+		exit.Reason = ExitHostKeyUnknown
+	case *TargetBlockedError:
+		exit.Reason = ExitTargetBlocked
+	case *KeepaliveError:
+		exit.Reason = ExitKeepaliveTimeout
+	default:
+		if isNetworkError(err) {
+			exit.Reason = ExitConnectionLost
+		}
+	}
+	return exit
+}
+
+// recoverSession is deferred by every goroutine working for a terminal, a panic is logged and
+// only closes that terminal instead of bringing the whole server down. sessionId is empty when
+// the goroutine doesn't own a terminal (yet).
+func recoverSession(sessionId string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	glog.Errorf("terminal %s: panic: %v\n%s", sessionId, r, debug.Stack())
+	if sessionId != "" {
+		terminalSessions.Close(sessionId, errorExit(fmt.Errorf("internal error: %v", r)))
+	}
+}
+
+// recoverCallback is deferred by the methods the ssh session calls from goroutines of its own,
+// which no recoverSession covers. A panic closes this session and is returned through err
+// instead of taking the server down. err may be nil for methods without an error result.
+func (t *TerminalSession) recoverCallback(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	glog.Errorf("terminal %s: panic: %v\n%s", t.id, r, debug.Stack())
+	e := fmt.Errorf("internal error: %v", r)
+	if err != nil {
+		*err = e
+	}
+	terminalSessions.Close(t.id, errorExit(e))
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestErrorExit(t *testing.T) {
+	tests := []struct {
+		err    error
+		reason ExitReason
+	}{
+		{&AuthError{User: "deploy", Addr: "10.0.0.1:22", Err: errors.New("no supported methods remain")}, ExitAuthFailed},
+		{&UnreachableError{Addr: "10.0.0.1:22", Err: errors.New("connection refused")}, ExitHostUnreachable},
+		{&HostKeyChangedError{Host: "10.0.0.1:22"}, ExitHostKeyMismatch},
+		{&HostKeyUnknownError{Host: "10.0.0.1:22"}, ExitHostKeyUnknown},
+		{&TargetBlockedError{Target: "127.0.0.1:22", Reason: "loopback"}, ExitTargetBlocked},
+		{io.EOF, ExitConnectionLost},
+		{errors.New("pty request failed"), ExitError},
+	}
+	for _, tt := range tests {
+		exit := errorExit(tt.err)
+		if exit.Reason != tt.reason || exit.Status != closeError || exit.Message != tt.err.Error() {
+			t.Errorf("%T: got %+v, want reason %s", tt.err, exit, tt.reason)
+		}
+	}
+
+	if exit := processExit(nil); exit.Reason != ExitProcessExited || exit.Status != closeProcessExited || exit.Code != 0 {
+		t.Errorf("a clean exit got %+v", exit)
+	}
+	if exit := processExit(&ssh.ExitMissingError{}); exit.Reason != ExitStatusMissing || exit.Status != closeError {
+		t.Errorf("a missing exit status got %+v", exit)
+	}
+	if exit := processExit(io.ErrUnexpectedEOF); exit.Reason != ExitConnectionLost || exit.Status != closeError {
+		t.Errorf("a lost connection got %+v", exit)
+	}
+}
+
+func TestSessionMapCloseSendsExit(t *testing.T) {
+	sm := &SessionMap{Sessions: make(map[string]*TerminalSession)}
+	alice := &Principal{Name: "alice"}
+	terminalSession := newTerminalSession("exit-test", alice, Host{}, nil)
+	sm.Set(terminalSession.id, terminalSession)
+	conn := newTestSockJSSession("exit")
+	defer close(conn.recv)
+	if _, _, err := sm.Bind(terminalSession.id, "", alice, newSockJSConn(conn, "127.0.0.1", TransportSockJS)); err != nil {
+		t.Fatal(err)
+	}
+
+	exit := errorExit(&TargetBlockedError{Target: "127.0.0.1:22", Reason: "loopback"})
+	sm.Close(terminalSession.id, exit)
+	if len(conn.sent) != 1 {
+		t.Fatalf("got %+v, want the exit message", conn.sent)
+	}
+	if msg := conn.sent[0]; msg.Op != "exit" || msg.Reason != string(ExitTargetBlocked) || msg.Data != exit.Message {
+		t.Errorf("got %+v, want the exit of the blocked target", msg)
+	}
+	if !conn.closed || conn.status != closeError || conn.reason != exit.Message {
+		t.Errorf("got closed %v with %d %q, want the status and message of the exit", conn.closed, conn.status, conn.reason)
+	}
+	if sm.Get(terminalSession.id) != nil {
+		t.Error("the terminal is still in the session map")
+	}
+
+	// closing it again does nothing
+	sm.Close(terminalSession.id, processExit(nil))
+	if len(conn.sent) != 1 {
+		t.Errorf("a second close sent %+v", conn.sent[1:])
+	}
+}
+
+// a panic in a goroutine of a terminal closes that terminal only
+func TestRecoverSession(t *testing.T) {
+	alice := &Principal{Name: "alice"}
+	terminalSession := newTerminalSession("recover-session-test", alice, Host{}, nil)
+	terminalSessions.Set(terminalSession.id, terminalSession)
+	conn := newTestSockJSSession("recover")
+	defer close(conn.recv)
+	if _, _, err := terminalSessions.Bind(terminalSession.id, "", alice, newSockJSConn(conn, "127.0.0.1", TransportSockJS)); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer recoverSession(terminalSession.id)
+		panic("boom")
+	}()
+	<-done
+	if terminalSessions.Get(terminalSession.id) != nil {
+		t.Fatal("the terminal is still open")
+	}
+	if !conn.closed || conn.status != closeError || len(conn.sent) != 1 || conn.sent[0].Reason != string(ExitError) {
+		t.Errorf("got closed %v with %d, sent %+v, want an error exit", conn.closed, conn.status, conn.sent)
+	}
+	// the resize goroutine stops once the terminal is closed
+	if size := terminalSession.Next(); size != nil {
+		t.Errorf("Next returned %+v after the terminal was closed", size)
+	}
+
+	// a goroutine that doesn't own a terminal just logs
+	func() {
+		defer recoverSession("")
+		panic("boom")
+	}()
+}
+
+// Write runs on a goroutine of the ssh session, a panic in it must only close its terminal
+func TestRecoverCallback(t *testing.T) {
+	terminalSession := newTerminalSession("recover-test", anonymous, Host{}, nil)
+	terminalSession.scrollback = nil // makes Write panic
+	terminalSessions.Lock.Lock()
+	terminalSessions.Sessions[terminalSession.id] = terminalSession
+	terminalSessions.Lock.Unlock()
+
+	n, err := terminalSession.Write([]byte("output"))
+	if err == nil || n != 0 {
+		t.Fatalf("got %d, %v, want an error", n, err)
+	}
+	if terminalSessions.Get(terminalSession.id) != nil {
+		t.Fatal("the terminal is still open")
+	}
+	select {
+	case <-terminalSession.done:
+	default:
+		t.Fatal("the terminal wasn't closed")
+	}
+}
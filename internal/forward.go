@@ -0,0 +1,452 @@
+package internal
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// forwardLocalHosts name the host of the terminal itself, they are forwarded whatever the target
+// policy says since the policy guards what the server connects to, not the remote loopback
+var forwardLocalHosts = []string{"localhost", "ip6-localhost"}
+
+// checkForwardTarget checks a target reached through the ssh connection of a terminal
+func checkForwardTarget(host string, port int) error {
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("bad port %d", port)
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	for _, local := range forwardLocalHosts {
+		if strings.EqualFold(host, local) {
+			return nil
+		}
+	}
+	return targetPolicy.Check(host, port)
+}
+
+// forwardConn is a direct-tcpip channel on the connection of a terminal, it is closed with the
+// terminal even though the pooled connection may outlive it
+type forwardConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *forwardConn) Close() error {
+	err := error(nil)
+	c.once.Do(func() {
+		close(c.closed)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+// dialForward opens a direct-tcpip channel from the host of the terminal to addr, like ssh -L
+func (t *TerminalSession) dialForward(addr string) (net.Conn, error) {
+	t.lock.Lock()
+	conn := t.conn
+	t.lock.Unlock()
+	if conn == nil {
+		return nil, fmt.Errorf("session '%s' is not connected yet", t.id)
+	}
+	select {
+	case <-t.done:
+		return nil, fmt.Errorf("session '%s' is closed", t.id)
+	default:
+	}
+	channel, err := conn.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &forwardConn{Conn: channel, closed: make(chan struct{})}
+	go func() {
+		defer recoverSession(t.id)
+		select {
+		case <-t.done:
+			_ = c.Close()
+		case <-c.closed:
+		}
+	}()
+	return c, nil
+}
+
+// portForward is a reverse-proxy path to a port reachable from the host of a terminal, only the
+// owner of the terminal and administrators may use it
+type portForward struct {
+	Id        string    `json:"id"`
+	SessionId string    `json:"sessionId"`
+	Host      string    `json:"host"`
+	Port      int       `json:"port"`
+	Path      string    `json:"path"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	proxy     *httputil.ReverseProxy
+	transport *http.Transport
+	secret    string     // value of the forward cookie
+	principal *Principal // who created the forward, the cookie stands for them
+}
+
+// forwardPathPrefix is where the reverse-proxy paths are served, behind Authenticate
+const forwardPathPrefix = "/v1/forward/"
+
+// forwardCookie carries the secret of a forward and is scoped to its path. The pages of a proxied
+// application load their scripts, styles and links without the bearer token, the cookie lets
+// them through AuthenticateForward.
+const forwardCookie = "web_terminal_forward"
+
+// forwardSandbox is the Content-Security-Policy of every proxied response. Without
+// allow-same-origin the pages of the application get an opaque origin, so their scripts can't
+// read the storage of the web terminal or call its API with the credentials of the browser.
+const forwardSandbox = "sandbox allow-scripts allow-forms allow-popups allow-modals allow-downloads"
+
+// forwardMap holds the reverse-proxy paths, they go away with their terminal
+type forwardMap struct {
+	lock     sync.RWMutex
+	forwards map[string]*portForward
+}
+
+var portForwards = &forwardMap{forwards: make(map[string]*portForward)}
+
+func (fm *forwardMap) Get(id string) *portForward {
+	fm.lock.RLock()
+	defer fm.lock.RUnlock()
+	return fm.forwards[id]
+}
+
+// List returns the forwards of a terminal
+func (fm *forwardMap) List(sessionId string) []*portForward {
+	fm.lock.RLock()
+	defer fm.lock.RUnlock()
+	forwards := make([]*portForward, 0)
+	for _, f := range fm.forwards {
+		if f.SessionId == sessionId {
+			forwards = append(forwards, f)
+		}
+	}
+	return forwards
+}
+
+// Remove deletes a forward of the terminal sessionId, false when there is no such forward
+func (fm *forwardMap) Remove(sessionId, id string) bool {
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+	f, ok := fm.forwards[id]
+	if !ok || f.SessionId != sessionId {
+		return false
+	}
+	delete(fm.forwards, id)
+	f.transport.CloseIdleConnections()
+	return true
+}
+
+// closeSession removes every forward of a closed terminal
+func (fm *forwardMap) closeSession(sessionId string) {
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+	for id, f := range fm.forwards {
+		if f.SessionId == sessionId {
+			delete(fm.forwards, id)
+			f.transport.CloseIdleConnections()
+		}
+	}
+}
+
+// newPortForward creates the reverse-proxy path to host:port through the terminal
+func newPortForward(t *TerminalSession, principal *Principal, host string, port int) (*portForward, error) {
+	id, err := genTerminalSessionId()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := genTerminalSessionId()
+	if err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	prefix := forwardPathPrefix + id
+	f := &portForward{
+		Id:        id,
+		SessionId: t.id,
+		Host:      host,
+		Port:      port,
+		Path:      prefix + "/",
+		CreatedAt: time.Now(),
+		secret:    secret,
+		principal: principal,
+		transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return t.dialForward(addr)
+			},
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     time.Minute,
+		},
+	}
+	f.proxy = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = addr
+			r.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+			r.URL.RawPath = ""
+			r.Host = addr
+			r.Header.Set("X-Forwarded-Prefix", prefix)
+			// the bearer token of the web terminal is none of the application's business
+			r.Header.Del("Authorization")
+			removeForwardCookie(r)
+		},
+		Transport: f.transport,
+		ModifyResponse: func(resp *http.Response) error {
+			// keep redirects of the application inside the path
+			if location := resp.Header.Get("Location"); strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "//") {
+				resp.Header.Set("Location", prefix+location)
+			}
+			resp.Header.Set("Content-Security-Policy", forwardSandbox)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("forward %s: %v", addr, err)
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = io.WriteString(w, err.Error())
+		},
+	}
+	return f, nil
+}
+
+// removeForwardCookie keeps the forward cookie away from the application
+func removeForwardCookie(r *http.Request) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != forwardCookie {
+			r.AddCookie(c)
+		}
+	}
+}
+
+// AuthenticateForward guards the reverse-proxy paths. A request carrying the cookie of the forward
+// is let through as the principal who created it, any other request goes through Authenticate.
+func AuthenticateForward() gin.HandlerFunc {
+	authenticate := Authenticate()
+	return func(context *gin.Context) {
+		if f := portForwards.Get(context.Param("forward")); f != nil {
+			cookie, err := context.Cookie(forwardCookie)
+			if err == nil && subtle.ConstantTimeCompare([]byte(cookie), []byte(f.secret)) == 1 {
+				context.Set(principalKey, f.principal)
+				context.Next()
+				return
+			}
+		}
+		authenticate(context)
+	}
+}
+
+type ForwardRequest struct {
+	Host string `json:"host"` // 默认localhost，即终端所在的主机
+	Port int    `json:"port"`
+}
+
+// forwardSession finds the terminal of the request, answering it when the principal may not
+// forward its ports
+func forwardSession(context *gin.Context) *TerminalSession {
+	sessionId := context.Param("id")
+	terminalSession := terminalSessions.Get(sessionId)
+	if terminalSession == nil {
+		Fail(fmt.Sprintf("can't find session '%s'", sessionId), context)
+		return nil
+	}
+	if !CurrentPrincipal(context).allowed(terminalSession.principal) {
+		context.JSON(http.StatusForbidden, http.StatusText(http.StatusForbidden))
+		return nil
+	}
+	return terminalSession
+}
+
+// failForwardTarget answers a target refused by checkForwardTarget
+func failForwardTarget(err error, context *gin.Context) {
+	if _, ok := err.(*TargetBlockedError); ok {
+		FailWithCode(TARGET_BLOCKED, err.Error(), context)
+		return
+	}
+	context.JSON(http.StatusBadRequest, err.Error())
+}
+
+// HandleCreateForward creates a reverse-proxy path to host:port (localhost by default) as seen from
+// the host of the terminal, it lives until it is deleted or the terminal closes
+func HandleCreateForward(context *gin.Context) {
+	var req ForwardRequest
+	if err := context.BindJSON(&req); err != nil {
+		return
+	}
+	if req.Host == "" {
+		req.Host = "localhost"
+	}
+	terminalSession := forwardSession(context)
+	if terminalSession == nil {
+		return
+	}
+	if err := checkForwardTarget(req.Host, req.Port); err != nil {
+		failForwardTarget(err, context)
+		return
+	}
+	f, err := newPortForward(terminalSession, CurrentPrincipal(context), req.Host, req.Port)
+	if err != nil {
+		Fail(err.Error(), context)
+		return
+	}
+	portForwards.lock.Lock()
+	portForwards.forwards[f.Id] = f
+	portForwards.lock.Unlock()
+	select {
+	case <-terminalSession.done:
+		// closed while the forward was created, closeSession has already run
+		portForwards.closeSession(terminalSession.id)
+		Fail(fmt.Sprintf("session '%s' is closed", terminalSession.id), context)
+		return
+	default:
+	}
+	SuccessWithData(f, context)
+}
+
+func HandleListForwards(context *gin.Context) {
+	terminalSession := forwardSession(context)
+	if terminalSession == nil {
+		return
+	}
+	SuccessWithData(portForwards.List(terminalSession.id), context)
+}
+
+func HandleDeleteForward(context *gin.Context) {
+	terminalSession := forwardSession(context)
+	if terminalSession == nil {
+		return
+	}
+	if !portForwards.Remove(terminalSession.id, context.Param("forward")) {
+		Fail(fmt.Sprintf("can't find forward '%s'", context.Param("forward")), context)
+		return
+	}
+	Success(context)
+}
+
+// HandleForwardProxy serves the reverse-proxy path to the owner of the terminal and administrators.
+// Once authenticated the browser gets the cookie of the forward, so the resources of the page need no token.
+func HandleForwardProxy(context *gin.Context) {
+	f := portForwards.Get(context.Param("forward"))
+	if f == nil {
+		context.JSON(http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
+	terminalSession := terminalSessions.Get(f.SessionId)
+	if terminalSession == nil {
+		context.JSON(http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
+	if !CurrentPrincipal(context).allowed(terminalSession.principal) {
+		context.JSON(http.StatusForbidden, http.StatusText(http.StatusForbidden))
+		return
+	}
+	if AuthEnabled() {
+		http.SetCookie(context.Writer, &http.Cookie{
+			Name:     forwardCookie,
+			Value:    f.secret,
+			Path:     f.Path,
+			HttpOnly: true,
+			Secure:   context.Request.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	if context.Param("path") == "" {
+		// relative links of the application need the trailing slash, the cookie set above
+		// authenticates the redirected request
+		context.Redirect(http.StatusFound, f.Path)
+		return
+	}
+	f.proxy.ServeHTTP(context.Writer, context.Request)
+}
+
+// tunnelBufferSize is the largest binary frame sent to the tunnel helper
+const tunnelBufferSize = 32 * 1024
+
+// HandleForwardTunnel opens a direct-tcpip channel to host:port for each WebSocket connection and
+// copies raw bytes both ways in binary frames, a local helper binds it to a local port like ssh -L
+func HandleForwardTunnel(context *gin.Context) {
+	host := context.DefaultQuery("host", "localhost")
+	port, err := strconv.Atoi(context.Query("port"))
+	if err != nil {
+		context.JSON(http.StatusBadRequest, fmt.Sprintf("bad port '%s'", context.Query("port")))
+		return
+	}
+	terminalSession := forwardSession(context)
+	if terminalSession == nil {
+		return
+	}
+	if err := checkForwardTarget(host, port); err != nil {
+		failForwardTarget(err, context)
+		return
+	}
+	channel, err := terminalSession.dialForward(net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		Fail(err.Error(), context)
+		return
+	}
+	defer channel.Close()
+	ws, err := webSocketUpgrader.Upgrade(context.Writer, context.Request, nil)
+	if err != nil {
+		// Upgrade has already answered the request
+		log.Printf("tunnel: %v", err)
+		return
+	}
+	defer ws.Close()
+	ws.SetReadLimit(webSocketMaxMessage)
+
+	go func() {
+		defer recoverSession(terminalSession.id)
+		defer channel.Close()
+		for {
+			messageType, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if messageType != websocket.BinaryMessage {
+				continue
+			}
+			if _, err := channel.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, tunnelBufferSize)
+	for {
+		n, err := channel.Read(buf)
+		if n > 0 {
+			_ = ws.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+			if werr := ws.WriteMessage(websocket.BinaryMessage, buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			reason := "EOF"
+			if err != io.EOF {
+				reason = err.Error()
+			}
+			if len(reason) > webSocketMaxReason {
+				reason = reason[:webSocketMaxReason]
+			}
+			msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason)
+			_ = ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+			return
+		}
+	}
+}
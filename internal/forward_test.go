@@ -0,0 +1,289 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+func TestCheckForwardTarget(t *testing.T) {
+	tests := []struct {
+		host    string
+		port    int
+		ok      bool
+		blocked bool
+	}{
+		{"localhost", 8080, true, false},
+		{"LOCALHOST", 80, true, false},
+		{"127.0.0.1", 5432, true, false},
+		{"::1", 22, true, false},
+		{"10.0.0.1", 80, true, false},
+		{"localhost", 0, false, false},
+		{"localhost", 65536, false, false},
+		{"169.254.169.254", 80, false, true},
+	}
+	for _, tt := range tests {
+		err := checkForwardTarget(tt.host, tt.port)
+		if tt.ok != (err == nil) {
+			t.Errorf("%s:%d: got %v, want ok %v", tt.host, tt.port, err, tt.ok)
+		}
+		if _, blocked := err.(*TargetBlockedError); blocked != tt.blocked {
+			t.Errorf("%s:%d: got %v, want blocked %v", tt.host, tt.port, err, tt.blocked)
+		}
+	}
+}
+
+// newForwardEngine serves the forward routes of main as principal
+func newForwardEngine(principal *Principal) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	v1 := engine.Group("/v1", func(context *gin.Context) { context.Set(principalKey, principal) })
+	v1.GET("/terminal/:id/tunnel", HandleForwardTunnel)
+	v1.Any("/forward/:forward", HandleForwardProxy)
+	v1.Any("/forward/:forward/*path", HandleForwardProxy)
+	return engine
+}
+
+func TestForwardProxy(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			http.Redirect(w, r, "/home", http.StatusFound)
+			return
+		}
+		_, _ = io.WriteString(w, r.Header.Get("X-Forwarded-Prefix")+" "+r.URL.Path)
+	}))
+	defer app.Close()
+
+	alice := &Principal{Name: "alice"}
+	terminalSession := newTerminalSession("forward-proxy-test", alice, Host{}, nil)
+	terminalSessions.Set(terminalSession.id, terminalSession)
+	defer terminalSessions.Close(terminalSession.id, TerminalExit{Reason: ExitProcessExited})
+	f, err := newPortForward(terminalSession, alice, "localhost", 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return net.Dial("tcp", app.Listener.Addr().String())
+	}
+	portForwards.lock.Lock()
+	portForwards.forwards[f.Id] = f
+	portForwards.lock.Unlock()
+
+	// the reverse proxy needs a ResponseWriter that is a CloseNotifier, a recorder isn't
+	server := httptest.NewServer(newForwardEngine(alice))
+	defer server.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	getFrom := func(server *httptest.Server, url string) (*http.Response, string) {
+		resp, err := client.Get(server.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+	get := func(url string) (*http.Response, string) { return getFrom(server, url) }
+
+	prefix := strings.TrimSuffix(f.Path, "/")
+	if resp, _ := get(prefix); resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != f.Path {
+		t.Errorf("without the slash: got %d to %q, want a redirect to %s", resp.StatusCode, resp.Header.Get("Location"), f.Path)
+	}
+	for _, p := range []string{"", "static/app.js"} {
+		if resp, body := get(f.Path + p); resp.StatusCode != http.StatusOK || body != prefix+" /"+p {
+			t.Errorf("%q: got %d %q", p, resp.StatusCode, body)
+		} else if resp.Header.Get("Content-Security-Policy") != forwardSandbox {
+			t.Errorf("%q: got Content-Security-Policy %q, want the sandbox", p, resp.Header.Get("Content-Security-Policy"))
+		}
+	}
+	if resp, _ := get(f.Path + "login"); resp.Header.Get("Location") != prefix+"/home" {
+		t.Errorf("got a redirect to %q, want it inside %s", resp.Header.Get("Location"), prefix)
+	}
+	if resp, _ := get(forwardPathPrefix + "guess/"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("an unknown forward got %d", resp.StatusCode)
+	}
+	bob := httptest.NewServer(newForwardEngine(&Principal{Name: "bob"}))
+	defer bob.Close()
+	if resp, _ := getFrom(bob, f.Path); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("another principal got %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+
+	if got := portForwards.List(terminalSession.id); len(got) != 1 || got[0] != f {
+		t.Errorf("got forwards %+v", got)
+	}
+	terminalSessions.Close(terminalSession.id, TerminalExit{Reason: ExitProcessExited})
+	if resp, _ := get(f.Path); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("the forward of a closed terminal got %d", resp.StatusCode)
+	}
+}
+
+func TestForwardTunnel(t *testing.T) {
+	defer withLoopbackPolicy()()
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	server := newTestSSHServer(t)
+	defer server.listener.Close()
+	conn, err := sshConnect(server.host())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	alice := &Principal{Name: "alice"}
+	terminalSession := newTerminalSession("forward-tunnel-test", alice, Host{}, nil)
+	terminalSession.setConnection(conn)
+	terminalSessions.Set(terminalSession.id, terminalSession)
+	defer terminalSessions.Close(terminalSession.id, TerminalExit{Reason: ExitProcessExited})
+
+	target := "host=127.0.0.1&port=" + strconv.Itoa(echo.Addr().(*net.TCPAddr).Port)
+	tunnel := func(principal *Principal, target string) (*websocket.Conn, *http.Response, error) {
+		server := httptest.NewServer(newForwardEngine(principal))
+		defer server.Close()
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + "/v1/terminal/" + terminalSession.id + "/tunnel?" + target
+		return websocket.DefaultDialer.Dial(url, nil)
+	}
+
+	// another principal learns nothing about the target, not even that it is blocked
+	bob := &Principal{Name: "bob"}
+	for _, target := range []string{target, "host=169.254.169.254&port=80"} {
+		if _, resp, err := tunnel(bob, target); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: another principal got %v, want %d", target, err, http.StatusForbidden)
+		}
+	}
+
+	ws, _, err := tunnel(alice, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if err := ws.WriteMessage(websocket.BinaryMessage, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if messageType, data, err := ws.ReadMessage(); err != nil || messageType != websocket.BinaryMessage || string(data) != "ping" {
+		t.Fatalf("got type %d %q, %v, want the echo", messageType, data, err)
+	}
+	if got := server.targets(); len(got) != 1 || got[0] != echo.Addr().String() {
+		t.Errorf("the ssh server forwarded to %v, want %s", got, echo.Addr())
+	}
+
+	// the channel is closed with the terminal, the tunnel with it
+	terminalSessions.Close(terminalSession.id, TerminalExit{Reason: ExitProcessExited})
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("got %v, want the tunnel closed", err)
+	}
+}
+
+// a browser opens the forward with the token in the URL, then follows the redirect and loads the
+// resources of the page with nothing but the cookie
+func TestForwardProxyAuthenticate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := r.Cookie(forwardCookie); err == nil {
+			t.Errorf("%s: the forward cookie reached the application", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("%s: the bearer token reached the application", r.URL.Path)
+		}
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	defer app.Close()
+
+	defer func(old []Authenticator) { authenticators = old }(authenticators)
+	authenticators = []Authenticator{&StaticTokenAuthenticator{tokens: map[string]Principal{
+		"alice-token": {Name: "alice"},
+		"bob-token":   {Name: "bob"},
+	}}}
+
+	alice := &Principal{Name: "alice"}
+	terminalSession := newTerminalSession("forward-test", alice, Host{}, nil)
+	terminalSessions.Set(terminalSession.id, terminalSession)
+	defer terminalSessions.Close(terminalSession.id, TerminalExit{Reason: ExitProcessExited})
+	f, err := newPortForward(terminalSession, alice, "localhost", 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return net.Dial("tcp", app.Listener.Addr().String())
+	}
+	portForwards.lock.Lock()
+	portForwards.forwards[f.Id] = f
+	portForwards.lock.Unlock()
+
+	engine := gin.New()
+	engine.Use(HideAccessToken())
+	forward := engine.Group("/v1/forward", AuthenticateForward())
+	forward.Any("/:forward", HandleForwardProxy)
+	forward.Any("/:forward/*path", HandleForwardProxy)
+	// the reverse proxy needs a ResponseWriter that is a CloseNotifier, a recorder isn't
+	server := httptest.NewServer(engine)
+	defer server.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	get := func(url string, cookie *http.Cookie) (*http.Response, string) {
+		r, err := http.NewRequest("GET", server.URL+url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		resp, err := client.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp, _ := get("/v1/forward/"+f.Id+"?access_token=alice-token", nil)
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != f.Path {
+		t.Fatalf("got %d to %q, want a redirect to %s", resp.StatusCode, resp.Header.Get("Location"), f.Path)
+	}
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == forwardCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.Path != f.Path || !cookie.HttpOnly {
+		t.Fatalf("got cookie %+v, want an HttpOnly cookie scoped to %s", cookie, f.Path)
+	}
+
+	for _, p := range []string{"", "static/app.js"} {
+		if resp, body := get(f.Path+p, cookie); resp.StatusCode != http.StatusOK || body != "/"+p {
+			t.Errorf("%s with the cookie: got %d %q", p, resp.StatusCode, body)
+		}
+	}
+	if resp, _ := get(f.Path, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without a token or cookie: got %d, want 401", resp.StatusCode)
+	}
+	if resp, _ := get(f.Path, &http.Cookie{Name: forwardCookie, Value: "guess"}); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("with a wrong cookie: got %d, want 401", resp.StatusCode)
+	}
+	if resp, _ := get(f.Path+"?access_token=bob-token", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("as another principal: got %d, want 403", resp.StatusCode)
+	}
+}
@@ -0,0 +1,414 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ansibleGroup is a group of an Ansible inventory, both formats are parsed into it
+type ansibleGroup struct {
+	hosts    []string
+	vars     map[string]string
+	children []string
+}
+
+// ansibleInventory is an Ansible inventory before it is turned into inventory hosts and groups
+type ansibleInventory struct {
+	groups     map[string]*ansibleGroup
+	groupOrder []string
+	hostVars   map[string]map[string]string
+	hostOrder  []string
+}
+
+func newAnsibleInventory() *ansibleInventory {
+	return &ansibleInventory{groups: make(map[string]*ansibleGroup), hostVars: make(map[string]map[string]string)}
+}
+
+func (a *ansibleInventory) group(name string) *ansibleGroup {
+	g, ok := a.groups[name]
+	if !ok {
+		g = &ansibleGroup{vars: make(map[string]string)}
+		a.groups[name] = g
+		a.groupOrder = append(a.groupOrder, name)
+	}
+	return g
+}
+
+func (a *ansibleInventory) addHost(group, host string, vars map[string]string) {
+	if _, ok := a.hostVars[host]; !ok {
+		a.hostVars[host] = make(map[string]string)
+		a.hostOrder = append(a.hostOrder, host)
+	}
+	for k, v := range vars {
+		a.hostVars[host][k] = v
+	}
+	g := a.group(group)
+	for _, h := range g.hosts {
+		if h == host {
+			return
+		}
+	}
+	g.hosts = append(g.hosts, host)
+}
+
+// ansibleVar returns the first of the given variables that is set, the ansible_ssh_* names are the
+// pre 2.0 spelling
+func ansibleVar(vars map[string]string, names ...string) string {
+	for _, name := range names {
+		if v := vars[name]; v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+var ansibleProxyJumpPattern = regexp.MustCompile(`(?:ProxyJump[= ]|-J ?)([^\s'"]+)`)
+
+// ansibleJumps finds a ProxyJump in ansible_ssh_common_args or ansible_ssh_extra_args
+func ansibleJumps(vars map[string]string) string {
+	m := ansibleProxyJumpPattern.FindStringSubmatch(ansibleVar(vars, "ansible_ssh_common_args", "ansible_ssh_extra_args"))
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// checkChildren refuses a group that is its own child, directly or through other groups,
+// Ansible refuses such an inventory too
+func (a *ansibleInventory) checkChildren() error {
+	const (
+		visiting = iota + 1
+		visited
+	)
+	state := make(map[string]int)
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("group '%s' is a child of itself", name)
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		for _, child := range a.groups[name].children {
+			if err := visit(child); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+	for _, name := range a.groupOrder {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// build turns the inventory into hosts and groups. A host belongs to its own groups, then their
+// parent groups, then "all", so the vars of the closest group win like in Ansible. The implicit
+// "ungrouped" group is dropped.
+func (a *ansibleInventory) build() (*importBuilder, error) {
+	if err := a.checkChildren(); err != nil {
+		return nil, err
+	}
+	b := newImportBuilder()
+	parents := make(map[string][]string)
+	for _, name := range a.groupOrder {
+		for _, child := range a.groups[name].children {
+			parents[child] = append(parents[child], name)
+		}
+	}
+	groupsOf := make(map[string][]string)
+	for _, name := range a.groupOrder {
+		for _, host := range a.groups[name].hosts {
+			groupsOf[host] = append(groupsOf[host], name)
+		}
+	}
+	known := func(name string) bool { _, ok := a.hostVars[name]; return ok }
+
+	var jumpSpecs []string
+	for _, name := range a.groupOrder {
+		if name == "ungrouped" {
+			continue
+		}
+		vars := a.groups[name].vars
+		g := &HostGroup{Name: name, User: ansibleVar(vars, "ansible_user", "ansible_ssh_user"),
+			IdentityFile: ansibleVar(vars, "ansible_ssh_private_key_file", "ansible_private_key_file")}
+		if port := ansibleVar(vars, "ansible_port", "ansible_ssh_port"); port != "" {
+			var err error
+			if g.Port, err = strconv.Atoi(port); err != nil {
+				b.warn("group '%s': bad port '%s'", name, port)
+			}
+		}
+		b.groups = append(b.groups, g)
+		jumpSpecs = append(jumpSpecs, ansibleJumps(vars))
+	}
+
+	for _, name := range a.hostOrder {
+		vars := a.hostVars[name]
+		h := &InventoryHost{Name: name, Address: name, User: ansibleVar(vars, "ansible_user", "ansible_ssh_user"),
+			IdentityFile: ansibleVar(vars, "ansible_ssh_private_key_file", "ansible_private_key_file")}
+		if address := ansibleVar(vars, "ansible_host", "ansible_ssh_host"); address != "" {
+			h.Address = address
+		}
+		if port := ansibleVar(vars, "ansible_port", "ansible_ssh_port"); port != "" {
+			var err error
+			if h.Port, err = strconv.Atoi(port); err != nil {
+				b.warn("host '%s': bad port '%s'", name, port)
+			}
+		}
+		seen := make(map[string]bool)
+		queue := append([]string{}, groupsOf[name]...)
+		for len(queue) > 0 {
+			group := queue[0]
+			queue = queue[1:]
+			if seen[group] {
+				continue
+			}
+			seen[group] = true
+			queue = append(queue, parents[group]...)
+			if group != "all" && group != "ungrouped" {
+				h.Groups = append(h.Groups, group)
+			}
+		}
+		if _, ok := a.groups["all"]; ok {
+			h.Groups = append(h.Groups, "all")
+		}
+		b.addHost(h)
+	}
+
+	for i, g := range b.groups {
+		g.Jumps = b.jumpNames(jumpSpecs[i], known)
+	}
+	for _, name := range a.hostOrder {
+		h := b.byName[name]
+		h.Jumps = b.jumpNames(ansibleJumps(a.hostVars[name]), known)
+	}
+	return b, nil
+}
+
+var ansibleRangePattern = regexp.MustCompile(`\[([0-9]+):([0-9]+)\]`)
+
+// maxAnsibleHosts limits how many hosts one pattern expands to, nested ranges included
+const maxAnsibleHosts = 10000
+
+// expandAnsibleHosts expands a numeric range like web[01:03].example.com
+func expandAnsibleHosts(pattern string) ([]string, error) {
+	m := ansibleRangePattern.FindStringSubmatchIndex(pattern)
+	if m == nil {
+		return []string{pattern}, nil
+	}
+	from, _ := strconv.Atoi(pattern[m[2]:m[3]])
+	to, _ := strconv.Atoi(pattern[m[4]:m[5]])
+	if to < from || to-from >= maxAnsibleHosts {
+		return nil, fmt.Errorf("bad host range '%s'", pattern)
+	}
+	rest, err := expandAnsibleHosts(pattern[m[1]:])
+	if err != nil {
+		return nil, err
+	}
+	if (to-from+1)*len(rest) > maxAnsibleHosts {
+		return nil, fmt.Errorf("host range '%s' expands to more than %d hosts", pattern, maxAnsibleHosts)
+	}
+	width := m[3] - m[2]
+	var hosts []string
+	for i := from; i <= to; i++ {
+		for _, r := range rest {
+			hosts = append(hosts, fmt.Sprintf("%s%0*d%s", pattern[:m[0]], width, i, r))
+		}
+	}
+	return hosts, nil
+}
+
+// unquoteAnsibleValue strips the double or single quotes around a value
+func unquoteAnsibleValue(value string) string {
+	if unquoted, err := strconv.Unquote(value); err == nil {
+		return unquoted
+	}
+	return strings.Trim(value, "'")
+}
+
+// parseAnsibleVars parses the key=value pairs of an INI host line, values may be quoted
+func parseAnsibleVars(fields []string) map[string]string {
+	vars := make(map[string]string)
+	for _, field := range fields {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		vars[kv[0]] = unquoteAnsibleValue(kv[1])
+	}
+	return vars
+}
+
+// parseAnsibleVarLine parses a line of a [group:vars] section, everything after the first = is the
+// value, spaces included
+func parseAnsibleVarLine(line string) (string, string, bool) {
+	i := strings.Index(line, "=")
+	if i < 0 {
+		return "", "", false
+	}
+	return strings.TrimSpace(line[:i]), unquoteAnsibleValue(strings.TrimSpace(line[i+1:])), true
+}
+
+// splitAnsibleLine splits on whitespace outside of quotes
+func splitAnsibleLine(line string) []string {
+	var fields []string
+	var field strings.Builder
+	var quote rune
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+			field.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			field.WriteRune(r)
+		case r == ' ' || r == '\t':
+			if field.Len() > 0 {
+				fields = append(fields, field.String())
+				field.Reset()
+			}
+		default:
+			field.WriteRune(r)
+		}
+	}
+	if field.Len() > 0 {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
+// parseAnsibleINI parses an INI inventory with [group], [group:vars], [group:children] sections
+// and host ranges like web[01:03]
+func parseAnsibleINI(content []byte) (*importBuilder, error) {
+	a := newAnsibleInventory()
+	section, kind := "ungrouped", ""
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section, kind = strings.Trim(line, "[]"), ""
+			if i := strings.Index(section, ":"); i >= 0 {
+				section, kind = section[:i], section[i+1:]
+			}
+			if kind != "" && kind != "vars" && kind != "children" {
+				return nil, fmt.Errorf("line %d: unknown section type '%s'", n, kind)
+			}
+			a.group(section)
+			continue
+		}
+		if kind == "vars" {
+			if k, v, ok := parseAnsibleVarLine(line); ok {
+				a.group(section).vars[k] = v
+			}
+			continue
+		}
+		fields := splitAnsibleLine(line)
+		switch kind {
+		case "children":
+			a.group(fields[0])
+			a.group(section).children = append(a.group(section).children, fields[0])
+		default:
+			hosts, err := expandAnsibleHosts(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			for _, host := range hosts {
+				a.addHost(section, host, parseAnsibleVars(fields[1:]))
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return a.build()
+}
+
+// ansibleYAMLGroup is a group of a YAML inventory, hosts map to their vars
+type ansibleYAMLGroup struct {
+	Hosts    map[string]map[string]interface{} `yaml:"hosts"`
+	Vars     map[string]interface{}            `yaml:"vars"`
+	Children map[string]*ansibleYAMLGroup      `yaml:"children"`
+}
+
+func stringVars(vars map[string]interface{}) map[string]string {
+	s := make(map[string]string, len(vars))
+	for k, v := range vars {
+		if v != nil {
+			s[k] = fmt.Sprint(v)
+		}
+	}
+	return s
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]*ansibleYAMLGroup:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]map[string]interface{}:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (a *ansibleInventory) addYAMLGroup(name string, group *ansibleYAMLGroup) error {
+	g := a.group(name)
+	if group == nil {
+		return nil
+	}
+	for k, v := range stringVars(group.Vars) {
+		g.vars[k] = v
+	}
+	for _, pattern := range sortedKeys(group.Hosts) {
+		hosts, err := expandAnsibleHosts(pattern)
+		if err != nil {
+			return err
+		}
+		for _, host := range hosts {
+			a.addHost(name, host, stringVars(group.Hosts[pattern]))
+		}
+	}
+	for _, child := range sortedKeys(group.Children) {
+		g.children = append(g.children, child)
+		if err := a.addYAMLGroup(child, group.Children[child]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseAnsibleYAML parses a YAML inventory, groups and hosts are imported in name order
+func parseAnsibleYAML(content []byte) (*importBuilder, error) {
+	var groups map[string]*ansibleYAMLGroup
+	if err := yaml.Unmarshal(content, &groups); err != nil {
+		return nil, err
+	}
+	a := newAnsibleInventory()
+	for _, name := range sortedKeys(groups) {
+		if err := a.addYAMLGroup(name, groups[name]); err != nil {
+			return nil, err
+		}
+	}
+	return a.build()
+}
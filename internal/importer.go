@@ -0,0 +1,278 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Import formats
+const (
+	ImportSSHConfig   = "ssh_config"
+	ImportAnsibleINI  = "ansible"
+	ImportAnsibleYAML = "ansible-yaml"
+)
+
+// Import actions
+const (
+	ImportAdd       = "add"
+	ImportUpdate    = "update"
+	ImportUnchanged = "unchanged"
+)
+
+// HostChange is what an import does to one host
+type HostChange struct {
+	Name    string         `json:"name"`
+	Action  string         `json:"action"`
+	Changes []string       `json:"changes,omitempty"` // "field: old -> new" for updates
+	Host    *InventoryHost `json:"host"`
+}
+
+// GroupChange is what an import does to one group
+type GroupChange struct {
+	Name    string     `json:"name"`
+	Action  string     `json:"action"`
+	Changes []string   `json:"changes,omitempty"`
+	Group   *HostGroup `json:"group"`
+}
+
+// ImportResult is the diff of an import, nothing is written when DryRun is set
+type ImportResult struct {
+	DryRun   bool          `json:"dryRun"`
+	Hosts    []HostChange  `json:"hosts"`
+	Groups   []GroupChange `json:"groups"`
+	Warnings []string      `json:"warnings"`
+}
+
+// importBuilder collects the hosts and groups parsed from a file
+type importBuilder struct {
+	hosts    []*InventoryHost
+	groups   []*HostGroup
+	byName   map[string]*InventoryHost
+	implicit map[string]bool // jump hosts only known from a ProxyJump, they don't replace inventory hosts
+	warnings []string
+}
+
+func newImportBuilder() *importBuilder {
+	return &importBuilder{byName: make(map[string]*InventoryHost), implicit: make(map[string]bool), warnings: make([]string, 0)}
+}
+
+func (b *importBuilder) warn(format string, args ...interface{}) {
+	b.warnings = append(b.warnings, fmt.Sprintf(format, args...))
+}
+
+func (b *importBuilder) addHost(h *InventoryHost) {
+	if h.Groups == nil {
+		h.Groups = make([]string, 0)
+	}
+	if h.Tags == nil {
+		h.Tags = make([]string, 0)
+	}
+	b.hosts = append(b.hosts, h)
+	b.byName[h.Name] = h
+}
+
+// jumpNames turns a comma separated ProxyJump value into inventory host names, hops that are not
+// hosts of the file become hosts of their own named after the spec
+func (b *importBuilder) jumpNames(spec string, known func(string) bool) []string {
+	if spec == "" || strings.EqualFold(spec, "none") {
+		return nil
+	}
+	var names []string
+	for _, hop := range strings.Split(spec, ",") {
+		hop = strings.TrimPrefix(strings.TrimSpace(hop), "ssh://")
+		if hop == "" {
+			continue
+		}
+		names = append(names, hop)
+		if known(hop) || b.byName[hop] != nil {
+			continue
+		}
+		h := &InventoryHost{Name: hop, Address: hop}
+		if at := strings.LastIndex(h.Address, "@"); at >= 0 {
+			h.User, h.Address = h.Address[:at], h.Address[at+1:]
+		}
+		if colon := strings.LastIndex(h.Address, ":"); colon >= 0 && !strings.Contains(h.Address[colon+1:], "]") {
+			port, err := strconv.Atoi(h.Address[colon+1:])
+			if err != nil {
+				b.warn("jump host '%s': bad port", hop)
+			}
+			h.Address, h.Port = h.Address[:colon], port
+		}
+		h.Address = strings.Trim(h.Address, "[]")
+		b.addHost(h)
+		b.implicit[hop] = true
+	}
+	return names
+}
+
+// DetectImportFormat guesses the format of an inventory file from its name and content, ssh_config
+// never has [section] lines
+func DetectImportFormat(name string, content []byte) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yml", ".yaml":
+		return ImportAnsibleYAML
+	case ".ini":
+		return ImportAnsibleINI
+	}
+	first := ""
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			return ImportAnsibleINI
+		}
+		if first == "" {
+			first = line
+		}
+	}
+	if first == "---" || strings.HasSuffix(first, ":") {
+		return ImportAnsibleYAML
+	}
+	return ImportSSHConfig
+}
+
+// parseInventory parses an ssh_config file or an Ansible INI or YAML inventory
+func parseInventory(format string, content []byte) (*importBuilder, error) {
+	switch format {
+	case ImportSSHConfig:
+		return parseSSHConfig(content)
+	case ImportAnsibleINI:
+		return parseAnsibleINI(content)
+	case ImportAnsibleYAML:
+		return parseAnsibleYAML(content)
+	}
+	return nil, fmt.Errorf("unknown import format '%s', expected %s, %s or %s",
+		format, ImportSSHConfig, ImportAnsibleINI, ImportAnsibleYAML)
+}
+
+// diffFields lists the JSON fields that differ between two values of the same type
+func diffFields(old, new interface{}) []string {
+	fields := func(v interface{}) map[string]interface{} {
+		m := make(map[string]interface{})
+		content, _ := json.Marshal(v)
+		_ = json.Unmarshal(content, &m)
+		return m
+	}
+	oldFields, newFields := fields(old), fields(new)
+	keys := make([]string, 0)
+	for k := range oldFields {
+		keys = append(keys, k)
+	}
+	for k := range newFields {
+		if _, ok := oldFields[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var changes []string
+	for _, k := range keys {
+		if !reflect.DeepEqual(oldFields[k], newFields[k]) {
+			oldValue, _ := json.Marshal(oldFields[k])
+			newValue, _ := json.Marshal(newFields[k])
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", k, oldValue, newValue))
+		}
+	}
+	return changes
+}
+
+// importHosts merges parsed hosts and groups into the inventory by name. Existing hosts keep their id,
+// tags and credential, hosts missing from the file are kept. Nothing is written on a dry run.
+func (inv *Inventory) importHosts(f *importBuilder, dryRun bool) (*ImportResult, error) {
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+	result := &ImportResult{DryRun: dryRun, Hosts: make([]HostChange, 0), Groups: make([]GroupChange, 0), Warnings: f.warnings}
+	hosts := make(map[string]*InventoryHost)
+	groups := make(map[string]*HostGroup)
+
+	for _, imported := range f.groups {
+		change := GroupChange{Name: imported.Name, Action: ImportAdd, Group: imported}
+		if old, ok := inv.groups[imported.Name]; ok {
+			g := *old
+			g.Port, g.User, g.IdentityFile, g.Jumps = imported.Port, imported.User, imported.IdentityFile, imported.Jumps
+			change.Group, change.Action = &g, ImportUnchanged
+			if change.Changes = diffFields(old, &g); len(change.Changes) > 0 {
+				change.Action = ImportUpdate
+			}
+		}
+		if change.Action != ImportUnchanged {
+			groups[change.Name] = change.Group
+		}
+		result.Groups = append(result.Groups, change)
+	}
+
+	for _, imported := range f.hosts {
+		change := HostChange{Name: imported.Name, Action: ImportAdd, Host: imported}
+		if old := inv.lookup(imported.Name); old != nil && f.implicit[imported.Name] {
+			change.Host, change.Action = old, ImportUnchanged
+		} else if old != nil {
+			h := *old
+			h.Address, h.Port, h.User, h.IdentityFile = imported.Address, imported.Port, imported.User, imported.IdentityFile
+			h.Jumps, h.Groups = imported.Jumps, imported.Groups
+			if imported.CredentialId != "" {
+				h.CredentialId = imported.CredentialId
+			}
+			if len(imported.Tags) > 0 {
+				h.Tags = imported.Tags
+			}
+			change.Host, change.Action = &h, ImportUnchanged
+			if change.Changes = diffFields(old, &h); len(change.Changes) > 0 {
+				change.Action = ImportUpdate
+			}
+		} else {
+			id, err := genTerminalSessionId()
+			if err != nil {
+				return nil, err
+			}
+			h := *imported
+			h.Id = id
+			change.Host = &h
+		}
+		if change.Action != ImportUnchanged {
+			hosts[change.Host.Id] = change.Host
+		}
+		result.Hosts = append(result.Hosts, change)
+	}
+	if dryRun || (len(hosts) == 0 && len(groups) == 0) {
+		return result, nil
+	}
+
+	oldHosts, oldGroups := inv.hosts, inv.groups
+	inv.hosts = make(map[string]*InventoryHost, len(oldHosts)+len(hosts))
+	inv.groups = make(map[string]*HostGroup, len(oldGroups)+len(groups))
+	for id, h := range oldHosts {
+		inv.hosts[id] = h
+	}
+	for name, g := range oldGroups {
+		inv.groups[name] = g
+	}
+	for id, h := range hosts {
+		inv.hosts[id] = h
+	}
+	for name, g := range groups {
+		inv.groups[name] = g
+	}
+	if err := inv.save(); err != nil {
+		inv.hosts, inv.groups = oldHosts, oldGroups
+		return nil, err
+	}
+	return result, nil
+}
+
+// ImportInventory parses content and merges it into the inventory opened by InitInventory
+func ImportInventory(format string, content []byte, dryRun bool) (*ImportResult, error) {
+	if inventory == nil {
+		return nil, errInventoryDisabled
+	}
+	parsed, err := parseInventory(format, content)
+	if err != nil {
+		return nil, err
+	}
+	return inventory.importHosts(parsed, dryRun)
+}
@@ -0,0 +1,314 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// importedHost is the part of an imported host the parsers fill in
+type importedHost struct {
+	Address, User, IdentityFile string
+	Port                        int
+	Jumps, Groups               []string
+}
+
+func importedHosts(b *importBuilder) map[string]importedHost {
+	hosts := make(map[string]importedHost)
+	for _, h := range b.hosts {
+		hosts[h.Name] = importedHost{Address: h.Address, User: h.User, IdentityFile: h.IdentityFile, Port: h.Port,
+			Jumps: h.Jumps, Groups: h.Groups}
+	}
+	return hosts
+}
+
+func TestParseInventory(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		content string
+		hosts   map[string]importedHost
+		groups  map[string]HostGroup // only checked when set
+	}{
+		{
+			name:   "ssh_config",
+			format: ImportSSHConfig,
+			content: `
+User nobody
+
+Host web db
+    HostName %h.example.com
+    Port=2222
+    ProxyJump admin@bastion:2200
+
+Host bastion
+    HostName "10.0.0.1"
+    IdentityFile ~/.ssh/bastion
+
+Host *
+    User deploy
+    Port 22
+`,
+			hosts: map[string]importedHost{
+				"web":                {Address: "web.example.com", User: "nobody", Port: 2222, Jumps: []string{"admin@bastion:2200"}, Groups: []string{}},
+				"db":                 {Address: "db.example.com", User: "nobody", Port: 2222, Jumps: []string{"admin@bastion:2200"}, Groups: []string{}},
+				"bastion":            {Address: "10.0.0.1", User: "nobody", Port: 22, IdentityFile: "~/.ssh/bastion", Groups: []string{}},
+				"admin@bastion:2200": {Address: "bastion", User: "admin", Port: 2200, Groups: []string{}},
+			},
+		},
+		{
+			name:   "ssh_config first match wins",
+			format: ImportSSHConfig,
+			content: `
+Host web
+    User first
+    User second
+
+Host !db *
+    Port 2222
+`,
+			hosts: map[string]importedHost{
+				"web": {Address: "web", User: "first", Port: 2222, Groups: []string{}},
+			},
+		},
+		{
+			name:   "ansible ini",
+			format: ImportAnsibleINI,
+			content: `
+bastion ansible_host=10.0.0.1
+
+[web]
+web[01:02].example.com ansible_user=deploy ansible_port=2222
+
+[db]
+db1 ansible_ssh_host=10.0.1.1 ansible_ssh_private_key_file="/keys/db key"
+
+[prod:children]
+web
+db
+
+[prod:vars]
+ansible_user = admin
+ansible_ssh_common_args=-o ProxyJump=bastion -o StrictHostKeyChecking=no
+`,
+			hosts: map[string]importedHost{
+				"bastion":           {Address: "10.0.0.1", Groups: []string{}},
+				"web01.example.com": {Address: "web01.example.com", User: "deploy", Port: 2222, Groups: []string{"web", "prod"}},
+				"web02.example.com": {Address: "web02.example.com", User: "deploy", Port: 2222, Groups: []string{"web", "prod"}},
+				"db1":               {Address: "10.0.1.1", IdentityFile: "/keys/db key", Groups: []string{"db", "prod"}},
+			},
+			groups: map[string]HostGroup{
+				"web":  {Name: "web"},
+				"db":   {Name: "db"},
+				"prod": {Name: "prod", User: "admin", Jumps: []string{"bastion"}},
+			},
+		},
+		{
+			name:   "ansible yaml",
+			format: ImportAnsibleYAML,
+			content: `
+all:
+  vars:
+    ansible_user: deploy
+  children:
+    web:
+      hosts:
+        web[1:2]:
+          ansible_port: 2222
+      vars:
+        ansible_ssh_common_args: "-J jump.example.com"
+`,
+			hosts: map[string]importedHost{
+				"web1":             {Address: "web1", Port: 2222, Groups: []string{"web", "all"}},
+				"web2":             {Address: "web2", Port: 2222, Groups: []string{"web", "all"}},
+				"jump.example.com": {Address: "jump.example.com", Groups: []string{}},
+			},
+			groups: map[string]HostGroup{
+				"all": {Name: "all", User: "deploy"},
+				"web": {Name: "web", Jumps: []string{"jump.example.com"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		b, err := parseInventory(tt.format, []byte(tt.content))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := importedHosts(b); !reflect.DeepEqual(got, tt.hosts) {
+			t.Errorf("%s: got hosts\n%+v\nwant\n%+v", tt.name, got, tt.hosts)
+		}
+		if tt.groups == nil {
+			continue
+		}
+		groups := make(map[string]HostGroup)
+		for _, g := range b.groups {
+			groups[g.Name] = *g
+		}
+		if !reflect.DeepEqual(groups, tt.groups) {
+			t.Errorf("%s: got groups\n%+v\nwant\n%+v", tt.name, groups, tt.groups)
+		}
+	}
+}
+
+func TestParseInventoryErrors(t *testing.T) {
+	tests := []struct {
+		format  string
+		content string
+	}{
+		{ImportAnsibleINI, "[web:hosts]\nweb1\n"},
+		{ImportAnsibleINI, "web[3:1]\n"},
+		{ImportAnsibleINI, "web[0:10000]\n"},
+		// each range is small, together they expand to a million hosts
+		{ImportAnsibleINI, "web[0:999]-[0:999]\n"},
+		{ImportAnsibleYAML, "all:\n  hosts:\n    web[0:999][0:999]:\n"},
+		// groups that are their own children
+		{ImportAnsibleINI, "[web:children]\nweb\n"},
+		{ImportAnsibleINI, "[web:children]\ndb\n[db:children]\napp\n[app:children]\nweb\n[app]\napp1\n"},
+		{ImportAnsibleYAML, "web:\n  children:\n    db:\ndb:\n  children:\n    web:\n      hosts:\n        web1:\n"},
+		{ImportAnsibleYAML, "all: [\n"},
+		{"csv", ""},
+	}
+	for _, tt := range tests {
+		if _, err := parseInventory(tt.format, []byte(tt.content)); err == nil {
+			t.Errorf("%s %q: parsed without an error", tt.format, tt.content)
+		}
+	}
+}
+
+func TestExpandAnsibleHosts(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"web", []string{"web"}},
+		{"web[1:3]", []string{"web1", "web2", "web3"}},
+		{"web[08:10].example.com", []string{"web08.example.com", "web09.example.com", "web10.example.com"}},
+		{"r[1:2]n[1:2]", []string{"r1n1", "r1n2", "r2n1", "r2n2"}},
+	}
+	for _, tt := range tests {
+		got, err := expandAnsibleHosts(tt.pattern)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, %v, want %v", tt.pattern, got, err, tt.want)
+		}
+	}
+}
+
+func TestDetectImportFormat(t *testing.T) {
+	tests := []struct {
+		name, content, want string
+	}{
+		{"hosts.yml", "", ImportAnsibleYAML},
+		{"hosts.ini", "", ImportAnsibleINI},
+		{"hosts", "# comment\n[web]\nweb1\n", ImportAnsibleINI},
+		{"hosts", "---\nall:\n", ImportAnsibleYAML},
+		{"hosts", "all:\n  hosts:\n", ImportAnsibleYAML},
+		{"config", "Host web\n  User deploy\n", ImportSSHConfig},
+	}
+	for _, tt := range tests {
+		if got := DetectImportFormat(tt.name, []byte(tt.content)); got != tt.want {
+			t.Errorf("%s %q: got %s, want %s", tt.name, tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestImportHostsDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	inv, err := loadInventory(filepath.Join(dir, "inventory.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	web, err := inv.SaveHost(InventoryHost{Name: "web", Address: "web.example.com", User: "deploy", CredentialId: "c1", Tags: []string{"prod"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inv.SaveHost(InventoryHost{Name: "db", Address: "db.example.com", User: "deploy"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inv.SaveHost(InventoryHost{Name: "bastion", Address: "10.0.0.1", User: "jump"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inv.SaveGroup(HostGroup{Name: "web", Description: "web servers", User: "deploy"}); err != nil {
+		t.Fatal(err)
+	}
+
+	content := `
+[web]
+web ansible_host=web.example.com ansible_user=admin
+new ansible_host=10.0.0.9
+
+[web:vars]
+ansible_user=deploy
+
+[db]
+db ansible_host=db.example.com ansible_user=deploy
+`
+	parse := func() *importBuilder {
+		b, err := parseAnsibleINI([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// bastion is only known from a ProxyJump, it must not overwrite the inventory host
+		b.jumpNames("bastion", func(string) bool { return false })
+		return b
+	}
+
+	result, err := inv.importHosts(parse(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := make(map[string]HostChange)
+	for _, c := range result.Hosts {
+		actions[c.Name] = c
+	}
+	wantActions := map[string]string{"web": ImportUpdate, "new": ImportAdd, "db": ImportUpdate, "bastion": ImportUnchanged}
+	for name, want := range wantActions {
+		if got := actions[name].Action; got != want {
+			t.Errorf("%s: got action %q, want %q", name, got, want)
+		}
+	}
+	if got, want := actions["web"].Changes, []string{`groups: [] -> ["web"]`, `user: "deploy" -> "admin"`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("web: got changes %q, want %q", got, want)
+	}
+	if got := actions["web"].Host; got.Id != web.Id || got.CredentialId != "c1" || !reflect.DeepEqual(got.Tags, []string{"prod"}) {
+		t.Errorf("web: id, credential or tags were not kept: %+v", got)
+	}
+	if len(result.Groups) != 2 || result.Groups[0].Action != ImportUnchanged || result.Groups[1].Action != ImportAdd {
+		t.Errorf("got group changes %+v, want web unchanged and db added", result.Groups)
+	}
+
+	// a dry run writes nothing
+	if h, _ := inv.Host("web"); h.User != "deploy" {
+		t.Errorf("dry run changed web: %+v", h)
+	}
+	if _, err := inv.Host("new"); err == nil {
+		t.Error("dry run added new")
+	}
+
+	if _, err := inv.importHosts(parse(), false); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := loadInventory(inv.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, err := reloaded.Host("web"); err != nil || h.User != "admin" || h.Id != web.Id {
+		t.Errorf("web after import: %+v, %v", h, err)
+	}
+	if h, err := reloaded.Host("bastion"); err != nil || h.User != "jump" {
+		t.Errorf("bastion after import: %+v, %v", h, err)
+	}
+	if _, err := reloaded.Host("new"); err != nil {
+		t.Error(err)
+	}
+	if g := reloaded.Groups(); len(g) != 2 || !strings.Contains(g[1].Description, "web") {
+		t.Errorf("groups after import: %+v", g)
+	}
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// sshConfigBlock is a Host block, options before the first Host line form a block matching every host
+type sshConfigBlock struct {
+	patterns []string
+	options  map[string]string
+}
+
+func (b *sshConfigBlock) matches(alias string) bool {
+	matched := false
+	for _, pattern := range b.patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		if ok, _ := path.Match(strings.TrimPrefix(pattern, "!"), alias); ok {
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// sshConfigOptions are the keywords the importer understands, lower case
+var sshConfigOptions = map[string]bool{"hostname": true, "user": true, "port": true, "proxyjump": true, "identityfile": true}
+
+// splitSSHConfigLine splits "Keyword value", "Keyword=value" and "Keyword = value", quotes around
+// the value are removed
+func splitSSHConfigLine(line string) (string, string) {
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return line, ""
+	}
+	keyword, value := line[:i], strings.TrimSpace(line[i:])
+	value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	return keyword, value
+}
+
+// parseSSHConfig imports every Host alias without wildcards as a host. Like ssh the first value
+// found in file order wins, wildcard blocks such as Host * provide the defaults.
+func parseSSHConfig(content []byte) (*importBuilder, error) {
+	b := newImportBuilder()
+	blocks := []*sshConfigBlock{{patterns: []string{"*"}, options: make(map[string]string)}}
+	var aliases []string
+	seen := make(map[string]bool)
+	skipping := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keyword, value := splitSSHConfigLine(line)
+		switch strings.ToLower(keyword) {
+		case "host":
+			block := &sshConfigBlock{patterns: strings.Fields(value), options: make(map[string]string)}
+			blocks = append(blocks, block)
+			skipping = false
+			for _, pattern := range block.patterns {
+				if !strings.ContainsAny(pattern, "*?!") && !seen[pattern] {
+					seen[pattern] = true
+					aliases = append(aliases, pattern)
+				}
+			}
+			continue
+		case "match":
+			b.warn("line %d: Match blocks are not supported, skipped", n)
+			skipping = true
+			continue
+		case "include", "proxycommand":
+			b.warn("line %d: %s is not supported, skipped", n, keyword)
+			continue
+		}
+		option := strings.ToLower(keyword)
+		block := blocks[len(blocks)-1]
+		if skipping || !sshConfigOptions[option] {
+			continue
+		}
+		if _, ok := block.options[option]; !ok {
+			block.options[option] = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	get := func(alias, option string) string {
+		for _, block := range blocks {
+			if value, ok := block.options[option]; ok && block.matches(alias) {
+				return value
+			}
+		}
+		return ""
+	}
+	for _, alias := range aliases {
+		h := &InventoryHost{Name: alias, Address: alias, User: get(alias, "user"), IdentityFile: get(alias, "identityfile")}
+		if hostName := get(alias, "hostname"); hostName != "" {
+			h.Address = strings.Replace(hostName, "%h", alias, -1)
+		}
+		if port := get(alias, "port"); port != "" {
+			var err error
+			if h.Port, err = strconv.Atoi(port); err != nil {
+				b.warn("host '%s': bad port '%s'", alias, port)
+			}
+		}
+		b.addHost(h)
+	}
+	for _, alias := range aliases {
+		b.byName[alias].Jumps = b.jumpNames(get(alias, "proxyjump"), func(name string) bool { return seen[name] })
+	}
+	return b, nil
+}
@@ -0,0 +1,409 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// InventoryHost is a saved connection profile
+type InventoryHost struct {
+	Id           string   `json:"id"`
+	Name         string   `json:"name"`
+	Address      string   `json:"address"`
+	Port         int      `json:"port,omitempty"`
+	User         string   `json:"user,omitempty"`
+	CredentialId string   `json:"credentialId,omitempty"`
+	IdentityFile string   `json:"identityFile,omitempty"` // private key file on the server, used without a credential
+	Jumps        []string `json:"jumps,omitempty"`        // ids or names of other inventory hosts, in dial order
+	Groups       []string `json:"groups"`
+	Tags         []string `json:"tags"`
+}
+
+// HostGroup holds the defaults of its hosts, a host inherits from the first of its groups that sets a value
+type HostGroup struct {
+	Name         string   `json:"name"`
+	Description  string   `json:"description,omitempty"`
+	Port         int      `json:"port,omitempty"`
+	User         string   `json:"user,omitempty"`
+	CredentialId string   `json:"credentialId,omitempty"`
+	IdentityFile string   `json:"identityFile,omitempty"`
+	Jumps        []string `json:"jumps,omitempty"`
+}
+
+type inventoryFile struct {
+	Hosts  []*InventoryHost `json:"hosts"`
+	Groups []*HostGroup     `json:"groups"`
+}
+
+// Inventory is the host inventory, persisted as a JSON file
+type Inventory struct {
+	path   string
+	lock   sync.RWMutex
+	hosts  map[string]*InventoryHost
+	groups map[string]*HostGroup
+}
+
+// maxJumpDepth stops jump host resolution running in circles
+const maxJumpDepth = 8
+
+var inventory *Inventory
+
+// InitInventory is called from main to load the inventory, the file is created on the first change
+// and an empty path disables the inventory
+func InitInventory(path string) error {
+	if path == "" {
+		return nil
+	}
+	inv, err := loadInventory(path)
+	if err != nil {
+		return err
+	}
+	inventory = inv
+	return nil
+}
+
+func loadInventory(path string) (*Inventory, error) {
+	inv := &Inventory{path: path, hosts: make(map[string]*InventoryHost), groups: make(map[string]*HostGroup)}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return inv, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f inventoryFile
+	if err := json.Unmarshal(content, &f); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, h := range f.Hosts {
+		inv.hosts[h.Id] = h
+	}
+	for _, g := range f.Groups {
+		inv.groups[g.Name] = g
+	}
+	return inv, nil
+}
+
+// save writes the inventory file, the caller must hold the lock
+func (inv *Inventory) save() error {
+	content, err := json.MarshalIndent(inventoryFile{Hosts: inv.sortedHosts(nil), Groups: inv.sortedGroups()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := inv.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, inv.path)
+}
+
+func (inv *Inventory) sortedHosts(filter func(*InventoryHost) bool) []*InventoryHost {
+	hosts := make([]*InventoryHost, 0, len(inv.hosts))
+	for _, h := range inv.hosts {
+		if filter == nil || filter(h) {
+			hosts = append(hosts, h)
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Name < hosts[j].Name })
+	return hosts
+}
+
+func (inv *Inventory) sortedGroups() []*HostGroup {
+	groups := make([]*HostGroup, 0, len(inv.groups))
+	for _, g := range inv.groups {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Hosts lists the hosts, optionally only those in group and carrying tag
+func (inv *Inventory) Hosts(group, tag string) []*InventoryHost {
+	inv.lock.RLock()
+	defer inv.lock.RUnlock()
+	return inv.sortedHosts(func(h *InventoryHost) bool {
+		return (group == "" || contains(h.Groups, group)) && (tag == "" || contains(h.Tags, tag))
+	})
+}
+
+// lookup finds a host by id or name, the caller must hold the lock
+func (inv *Inventory) lookup(idOrName string) *InventoryHost {
+	if h, ok := inv.hosts[idOrName]; ok {
+		return h
+	}
+	for _, h := range inv.hosts {
+		if h.Name == idOrName {
+			return h
+		}
+	}
+	return nil
+}
+
+// Host returns a copy of a host found by id or name
+func (inv *Inventory) Host(idOrName string) (*InventoryHost, error) {
+	inv.lock.RLock()
+	defer inv.lock.RUnlock()
+	h := inv.lookup(idOrName)
+	if h == nil {
+		return nil, fmt.Errorf("can't find host '%s'", idOrName)
+	}
+	host := *h
+	return &host, nil
+}
+
+// validate checks a host before it is stored, the caller must hold the lock
+func (inv *Inventory) validate(h *InventoryHost) error {
+	if h.Name == "" || h.Address == "" {
+		return errors.New("name and address are required")
+	}
+	if other := inv.lookup(h.Name); other != nil && other.Id != h.Id {
+		return fmt.Errorf("host name '%s' is already used by %s", h.Name, other.Id)
+	}
+	if h.Groups == nil {
+		h.Groups = make([]string, 0)
+	}
+	if h.Tags == nil {
+		h.Tags = make([]string, 0)
+	}
+	return nil
+}
+
+// SaveHost creates a host when its id is empty, or replaces the host with that id
+func (inv *Inventory) SaveHost(h InventoryHost) (*InventoryHost, error) {
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+	if h.Id == "" {
+		id, err := genTerminalSessionId()
+		if err != nil {
+			return nil, err
+		}
+		h.Id = id
+	} else if _, ok := inv.hosts[h.Id]; !ok {
+		return nil, fmt.Errorf("can't find host '%s'", h.Id)
+	}
+	if err := inv.validate(&h); err != nil {
+		return nil, err
+	}
+	old := inv.hosts[h.Id]
+	inv.hosts[h.Id] = &h
+	if err := inv.save(); err != nil {
+		if old == nil {
+			delete(inv.hosts, h.Id)
+		} else {
+			inv.hosts[h.Id] = old
+		}
+		return nil, err
+	}
+	return &h, nil
+}
+
+// DeleteHost removes a host
+func (inv *Inventory) DeleteHost(id string) error {
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+	old, ok := inv.hosts[id]
+	if !ok {
+		return fmt.Errorf("can't find host '%s'", id)
+	}
+	delete(inv.hosts, id)
+	if err := inv.save(); err != nil {
+		inv.hosts[id] = old
+		return err
+	}
+	return nil
+}
+
+// Groups lists the groups
+func (inv *Inventory) Groups() []*HostGroup {
+	inv.lock.RLock()
+	defer inv.lock.RUnlock()
+	return inv.sortedGroups()
+}
+
+// SaveGroup creates or replaces a group
+func (inv *Inventory) SaveGroup(g HostGroup) (*HostGroup, error) {
+	if g.Name == "" {
+		return nil, errors.New("name is required")
+	}
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+	old := inv.groups[g.Name]
+	inv.groups[g.Name] = &g
+	if err := inv.save(); err != nil {
+		if old == nil {
+			delete(inv.groups, g.Name)
+		} else {
+			inv.groups[g.Name] = old
+		}
+		return nil, err
+	}
+	return &g, nil
+}
+
+// DeleteGroup removes a group, its hosts keep the group name but no longer inherit from it
+func (inv *Inventory) DeleteGroup(name string) error {
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+	old, ok := inv.groups[name]
+	if !ok {
+		return fmt.Errorf("can't find group '%s'", name)
+	}
+	delete(inv.groups, name)
+	if err := inv.save(); err != nil {
+		inv.groups[name] = old
+		return err
+	}
+	return nil
+}
+
+// Resolve turns an inventory host into the Host used to connect, group defaults and jump hosts
+// included. Passwords and keys are not part of the inventory, they come from the vault, an
+// identity file is only referenced and read by resolveInventoryHost once the caller may use it.
+func (inv *Inventory) Resolve(idOrName string) (Host, error) {
+	inv.lock.RLock()
+	defer inv.lock.RUnlock()
+	return inv.resolve(idOrName, 0)
+}
+
+func (inv *Inventory) resolve(idOrName string, depth int) (Host, error) {
+	if depth > maxJumpDepth {
+		return Host{}, fmt.Errorf("jump hosts of '%s' are nested too deep, is there a loop?", idOrName)
+	}
+	h := inv.lookup(idOrName)
+	if h == nil {
+		return Host{}, fmt.Errorf("can't find host '%s'", idOrName)
+	}
+	host := Host{Ip: h.Address, Port: h.Port, Username: h.User, CredentialId: h.CredentialId, HostId: h.Id}
+	identityFile, jumps := h.IdentityFile, h.Jumps
+	for _, name := range h.Groups {
+		g, ok := inv.groups[name]
+		if !ok {
+			continue
+		}
+		if host.Port == 0 {
+			host.Port = g.Port
+		}
+		if host.Username == "" {
+			host.Username = g.User
+		}
+		if host.CredentialId == "" {
+			host.CredentialId = g.CredentialId
+		}
+		if identityFile == "" {
+			identityFile = g.IdentityFile
+		}
+		if len(jumps) == 0 {
+			jumps = g.Jumps
+		}
+	}
+	if host.Port == 0 {
+		host.Port = 22
+	}
+	if host.CredentialId == "" {
+		host.identityFile = identityFile
+	}
+	for _, jump := range jumps {
+		hop, err := inv.resolve(jump, depth+1)
+		if err != nil {
+			return Host{}, err
+		}
+		// 跳板机自己的跳板机排在前面，展开成一条链路
+		host.Jumps = append(host.Jumps, hop.Jumps...)
+		hop.Jumps = nil
+		host.Jumps = append(host.Jumps, hop)
+	}
+	return host, nil
+}
+
+// readIdentityFile reads a private key referenced by the inventory, ~/ is the home of the server user.
+// The error doesn't name the file, the path on the server is none of the caller's business.
+func readIdentityFile(hostId, path string) (string, error) {
+	if strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			glog.Errorf("identity file of host %s: %v", hostId, err)
+			return "", fmt.Errorf("can't read the identity file of host '%s'", hostId)
+		}
+		path = filepath.Join(home, path[2:])
+	}
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		glog.Errorf("identity file of host %s: %v", hostId, err)
+		return "", fmt.Errorf("can't read the identity file of host '%s'", hostId)
+	}
+	return string(key), nil
+}
+
+// loadIdentityFile puts the server key of an inventory host into host. The key belongs to the
+// server and not to the caller, so only administrators may connect with it.
+func loadIdentityFile(host *Host, principal *Principal) error {
+	if host.identityFile == "" {
+		return nil
+	}
+	if !principal.Admin {
+		return fmt.Errorf("host '%s' uses a key stored on the server, only administrators can connect with it", host.HostId)
+	}
+	key, err := readIdentityFile(host.HostId, host.identityFile)
+	if err != nil {
+		return err
+	}
+	host.PrivateKey, host.identityFile = key, ""
+	return nil
+}
+
+// resolveInventoryHost replaces host with the inventory host it references, the fields given in
+// the request (user, credentials) take precedence over the saved profile. A host connecting with
+// a server key keeps the user of the profile, otherwise the key could be used to log in as anyone.
+func resolveInventoryHost(host *Host, principal *Principal) error {
+	if host.HostId == "" {
+		return nil
+	}
+	if inventory == nil {
+		return errInventoryDisabled
+	}
+	resolved, err := inventory.Resolve(host.HostId)
+	if err != nil {
+		return err
+	}
+	if host.Password != "" || host.PrivateKey != "" || host.CredentialId != "" {
+		resolved.Password, resolved.PrivateKey, resolved.Passphrase = host.Password, host.PrivateKey, host.Passphrase
+		resolved.CredentialId = host.CredentialId
+		resolved.identityFile = ""
+	}
+	if host.Username != "" && host.Username != resolved.Username {
+		if resolved.identityFile != "" {
+			return fmt.Errorf("host '%s' uses a key stored on the server, its user can't be changed", resolved.HostId)
+		}
+		resolved.Username = host.Username
+	}
+	if len(host.Jumps) > 0 {
+		resolved.Jumps = host.Jumps
+	}
+	if err := loadIdentityFile(&resolved, principal); err != nil {
+		return err
+	}
+	for i := range resolved.Jumps {
+		if err := loadIdentityFile(&resolved.Jumps[i], principal); err != nil {
+			return err
+		}
+	}
+	*host = resolved
+	return nil
+}
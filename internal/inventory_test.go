@@ -0,0 +1,215 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestInventory(t *testing.T) (*Inventory, func()) {
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv, err := loadInventory(filepath.Join(dir, "inventory.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inv, func() { os.RemoveAll(dir) }
+}
+
+func saveTestHosts(t *testing.T, inv *Inventory, hosts ...InventoryHost) {
+	for _, h := range hosts {
+		if _, err := inv.SaveHost(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestInventoryResolve(t *testing.T) {
+	inv, cleanup := newTestInventory(t)
+	defer cleanup()
+	for _, g := range []HostGroup{
+		{Name: "dc1", Port: 2222, User: "ops", Jumps: []string{"bastion"}},
+		{Name: "web", Port: 8022, User: "www", CredentialId: "web-cred"},
+	} {
+		if _, err := inv.SaveGroup(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saveTestHosts(t, inv,
+		InventoryHost{Name: "edge", Address: "10.0.0.1"},
+		InventoryHost{Name: "bastion", Address: "10.0.1.1", User: "jump", Jumps: []string{"edge"}},
+		InventoryHost{Name: "web1", Address: "10.0.1.10", Groups: []string{"dc1", "web"}, Tags: []string{"prod"}},
+		InventoryHost{Name: "web2", Address: "10.0.1.11", Port: 22, User: "deploy", Groups: []string{"web", "dc1"}},
+		InventoryHost{Name: "db", Address: "10.0.1.20", Jumps: []string{"gone"}},
+		InventoryHost{Name: "loop-a", Address: "10.0.2.1", Jumps: []string{"loop-b"}},
+		InventoryHost{Name: "loop-b", Address: "10.0.2.2", Jumps: []string{"loop-a"}},
+	)
+
+	web1, err := inv.Resolve("web1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first group that sets a value wins
+	if web1.Port != 2222 || web1.Username != "ops" || web1.CredentialId != "web-cred" {
+		t.Errorf("web1 got %s@%s:%d with credential %q, want ops on port 2222 with web-cred", web1.Username, web1.Ip, web1.Port, web1.CredentialId)
+	}
+	// the jump host of the bastion comes first, the chain is flat
+	if len(web1.Jumps) != 2 || web1.Jumps[0].Ip != "10.0.0.1" || web1.Jumps[0].Port != 22 ||
+		web1.Jumps[1].Ip != "10.0.1.1" || web1.Jumps[1].Username != "jump" || len(web1.Jumps[1].Jumps) != 0 {
+		t.Errorf("web1 got jumps %+v, want edge then bastion", web1.Jumps)
+	}
+
+	// the profile takes precedence over its groups, and hosts are found by id too
+	web2, err := inv.Host("web2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolved, err := inv.Resolve(web2.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Port != 22 || resolved.Username != "deploy" || resolved.CredentialId != "web-cred" || len(resolved.Jumps) != 2 {
+		t.Errorf("web2 got %+v", resolved)
+	}
+
+	for _, name := range []string{"db", "loop-a", "nope"} {
+		if _, err := inv.Resolve(name); err == nil {
+			t.Errorf("%s: resolved without an error", name)
+		}
+	}
+
+	if hosts := inv.Hosts("web", "prod"); len(hosts) != 1 || hosts[0].Name != "web1" {
+		t.Errorf("got %+v for group web and tag prod, want web1", hosts)
+	}
+	if hosts := inv.Hosts("dc1", ""); len(hosts) != 2 || hosts[0].Name != "web1" || hosts[1].Name != "web2" {
+		t.Errorf("got %+v for group dc1, want web1 and web2", hosts)
+	}
+	if _, err := inv.SaveHost(InventoryHost{Name: "web1", Address: "10.0.1.12"}); err == nil {
+		t.Error("saved two hosts with the same name")
+	}
+
+	reloaded, err := loadInventory(inv.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := reloaded.Resolve("web1"); err != nil || got.Port != 2222 || len(got.Jumps) != 2 {
+		t.Errorf("after reloading got %+v, %v", got, err)
+	}
+}
+
+func TestResolveInventoryHost(t *testing.T) {
+	inv, cleanup := newTestInventory(t)
+	defer cleanup()
+	saveTestHosts(t, inv,
+		InventoryHost{Name: "bastion", Address: "10.0.0.1", User: "jump"},
+		InventoryHost{Name: "web", Address: "10.0.0.2", User: "deploy", CredentialId: "saved", Jumps: []string{"bastion"}},
+	)
+	defer func(old *Inventory) { inventory = old }(inventory)
+	alice := &Principal{Name: "alice"}
+	inventory = nil
+	if err := resolveInventoryHost(&Host{HostId: "web"}, alice); err == nil {
+		t.Error("resolved a host with the inventory disabled")
+	}
+	inventory = inv
+
+	web, err := inv.Host("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := Host{HostId: "web"}
+	if err := resolveInventoryHost(&host, alice); err != nil {
+		t.Fatal(err)
+	}
+	// the host is found by its name and HostId becomes its id
+	if host.Ip != "10.0.0.2" || host.Username != "deploy" || host.CredentialId != "saved" || len(host.Jumps) != 1 || host.HostId != web.Id {
+		t.Errorf("got %+v, want the saved profile", host)
+	}
+
+	// what the request brings replaces the profile
+	host = Host{HostId: "web", Username: "root", Password: "secret", Jumps: []Host{{Ip: "10.0.0.9"}}}
+	if err := resolveInventoryHost(&host, alice); err != nil {
+		t.Fatal(err)
+	}
+	if host.Ip != "10.0.0.2" || host.Username != "root" || host.Password != "secret" || host.CredentialId != "" ||
+		len(host.Jumps) != 1 || host.Jumps[0].Ip != "10.0.0.9" {
+		t.Errorf("got %+v, want the user, password and jumps of the request", host)
+	}
+
+	host = Host{Ip: "10.0.0.5"}
+	if err := resolveInventoryHost(&host, alice); err != nil || host.Ip != "10.0.0.5" {
+		t.Errorf("a host without a host id got %+v, %v", host, err)
+	}
+}
+
+func TestResolveInventoryHostIdentityFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "id_rsa")
+	if err := ioutil.WriteFile(keyFile, []byte("server key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	inv, err := loadInventory(filepath.Join(dir, "inventory.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inv.SaveHost(InventoryHost{Name: "bastion", Address: "10.0.0.1", User: "jump", IdentityFile: keyFile}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inv.SaveHost(InventoryHost{Name: "web", Address: "10.0.0.2", User: "deploy", Jumps: []string{"bastion"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inv.SaveHost(InventoryHost{Name: "missing", Address: "10.0.0.3", User: "deploy", IdentityFile: filepath.Join(dir, "nope")}); err != nil {
+		t.Fatal(err)
+	}
+	defer func(old *Inventory) { inventory = old }(inventory)
+	inventory = inv
+
+	admin := &Principal{Name: "root", Admin: true}
+	alice := &Principal{Name: "alice"}
+
+	host := Host{HostId: "bastion"}
+	if err := resolveInventoryHost(&host, admin); err != nil {
+		t.Fatal(err)
+	}
+	if host.PrivateKey != "server key" || host.Username != "jump" {
+		t.Errorf("admin got user %q and key %q, want the server key for jump", host.Username, host.PrivateKey)
+	}
+
+	tests := []struct {
+		name      string
+		host      Host
+		principal *Principal
+		ok        bool
+	}{
+		{"user can't use the server key", Host{HostId: "bastion"}, alice, false},
+		{"user can't use the server key of a jump host", Host{HostId: "web"}, alice, false},
+		{"user brings a key", Host{HostId: "bastion", PrivateKey: "own key"}, alice, true},
+		{"user brings a key and a user", Host{HostId: "bastion", Username: "root", PrivateKey: "own key"}, alice, true},
+		{"admin can't change the user", Host{HostId: "bastion", Username: "root"}, admin, false},
+		{"admin keeps the user", Host{HostId: "bastion", Username: "jump"}, admin, true},
+		{"jump host with the server key", Host{HostId: "web"}, admin, true},
+	}
+	for _, tt := range tests {
+		host := tt.host
+		err := resolveInventoryHost(&host, tt.principal)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: resolved without an error", tt.name)
+		}
+	}
+
+	host = Host{HostId: "missing"}
+	err = resolveInventoryHost(&host, admin)
+	if err == nil || strings.Contains(err.Error(), dir) {
+		t.Errorf("got %v, want an error that doesn't name the file", err)
+	}
+}
@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errInventoryDisabled = errors.New("the host inventory is not configured")
+
+// HandleListHosts lists the inventory, filtered by the group and tag query parameters
+func HandleListHosts(context *gin.Context) {
+	if inventory == nil {
+		Fail(errInventoryDisabled.Error(), context)
+		return
+	}
+	SuccessWithData(inventory.Hosts(context.Query("group"), context.Query("tag")), context)
+}
+
+func HandleGetHost(context *gin.Context) {
+	if inventory == nil {
+		Fail(errInventoryDisabled.Error(), context)
+		return
+	}
+	host, err := inventory.Host(context.Param("id"))
+	if err != nil {
+		Fail(err.Error(), context)
+		return
+	}
+	SuccessWithData(host, context)
+}
+
+// HandleSaveHost creates a host, or replaces the whole host given by the path
+func HandleSaveHost(context *gin.Context) {
+	var host InventoryHost
+	if err := context.BindJSON(&host); err != nil || host.Name == "" || host.Address == "" {
+		context.JSON(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	if inventory == nil {
+		Fail(errInventoryDisabled.Error(), context)
+		return
+	}
+	host.Id = context.Param("id")
+	saved, err := inventory.SaveHost(host)
+	if err != nil {
+		Fail(err.Error(), context)
+		return
+	}
+	SuccessWithData(saved, context)
+}
+
+func HandleDeleteHost(context *gin.Context) {
+	if inventory == nil {
+		Fail(errInventoryDisabled.Error(), context)
+		return
+	}
+	if err := inventory.DeleteHost(context.Param("id")); err != nil {
+		Fail(err.Error(), context)
+		return
+	}
+	Success(context)
+}
+
+func HandleListHostGroups(context *gin.Context) {
+	if inventory == nil {
+		Fail(errInventoryDisabled.Error(), context)
+		return
+	}
+	SuccessWithData(inventory.Groups(), context)
+}
+
+// HandleSaveHostGroup creates or replaces the group named by the path
+func HandleSaveHostGroup(context *gin.Context) {
+	var group HostGroup
+	if err := context.BindJSON(&group); err != nil {
+		context.JSON(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	if inventory == nil {
+		Fail(errInventoryDisabled.Error(), context)
+		return
+	}
+	group.Name = context.Param("name")
+	saved, err := inventory.SaveGroup(group)
+	if err != nil {
+		Fail(err.Error(), context)
+		return
+	}
+	SuccessWithData(saved, context)
+}
+
+func HandleDeleteHostGroup(context *gin.Context) {
+	if inventory == nil {
+		Fail(errInventoryDisabled.Error(), context)
+		return
+	}
+	if err := inventory.DeleteGroup(context.Param("name")); err != nil {
+		Fail(err.Error(), context)
+		return
+	}
+	Success(context)
+}
+
+// HandleImportInventory imports the ssh_config or Ansible inventory in the request body. format is
+// guessed from the content when empty, dryRun only returns the diff.
+func HandleImportInventory(context *gin.Context) {
+	content, err := ioutil.ReadAll(context.Request.Body)
+	if err != nil || len(content) == 0 {
+		context.JSON(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	if inventory == nil {
+		Fail(errInventoryDisabled.Error(), context)
+		return
+	}
+	format := context.Query("format")
+	if format == "" {
+		format = DetectImportFormat("", content)
+	}
+	parsed, err := parseInventory(format, content)
+	if err != nil {
+		context.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	result, err := inventory.importHosts(parsed, context.Query("dryRun") == "true")
+	if err != nil {
+		Fail(err.Error(), context)
+		return
+	}
+	SuccessWithData(result, context)
+}
@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/crypto/ssh"
+)
+
+// KeepaliveInterval is how often every ssh connection is probed, 0 disables the probes
+var KeepaliveInterval = 30 * time.Second
+
+// KeepaliveCountMax is how many probes may go unanswered before the connection is closed
+var KeepaliveCountMax = 3
+
+// KeepaliveError is why a connection was closed when a host stopped answering keepalives
+type KeepaliveError struct {
+	Addr   string
+	Missed int
+}
+
+func (e *KeepaliveError) Error() string {
+	return fmt.Sprintf("%s stopped responding, %d keepalives went unanswered", e.Addr, e.Missed)
+}
+
+// lostError returns why the connection was closed by a keepalive, nil while it is alive
+func (c *sshConnection) lostError() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lost
+}
+
+// keepAlive sends a keepalive@openssh.com global request every KeepaliveInterval, like the
+// ServerAliveInterval of ssh. When KeepaliveCountMax probes in a row go unanswered the whole
+// connection is closed, so the shells on it end instead of hanging. It returns once client is closed.
+func (c *sshConnection) keepAlive(client *ssh.Client, addr string) {
+	defer recoverSession("")
+	ticker := time.NewTicker(KeepaliveInterval)
+	defer ticker.Stop()
+	replies := make(chan error, 1)
+	pending, missed := false, 0
+	for {
+		select {
+		case err := <-replies:
+			if err != nil { // closed
+				return
+			}
+			pending, missed = false, 0
+		case <-ticker.C:
+			if !pending {
+				pending = true
+				go func() {
+					_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+					replies <- err
+				}()
+				continue
+			}
+			if missed++; missed < KeepaliveCountMax {
+				continue
+			}
+			err := &KeepaliveError{Addr: addr, Missed: missed}
+			glog.Error(err)
+			c.lock.Lock()
+			if c.lost == nil {
+				c.lost = err
+			}
+			c.lock.Unlock()
+			_ = c.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeepaliveDeadPeer(t *testing.T) {
+	defer withLoopbackPolicy()()
+	defer func(old int) { KeepaliveCountMax = old }(KeepaliveCountMax)
+	KeepaliveInterval, KeepaliveCountMax = 20*time.Millisecond, 2
+	jump, target := newTestSSHServer(t), newTestSSHServer(t)
+	defer jump.listener.Close()
+	defer target.listener.Close()
+	host := target.host()
+	host.Jumps = []Host{jump.host()}
+
+	conn, err := sshConnect(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// answered probes keep the connection open, refusing them is an answer too
+	time.Sleep(10 * KeepaliveInterval)
+	if err := conn.lostError(); err != nil {
+		t.Fatalf("a live connection was closed: %v", err)
+	}
+
+	// the jump host stops answering, the whole chain goes down
+	jump.mute()
+	waitFor(t, "the keepalive to give up", func() bool { return conn.lostError() != nil })
+	err = conn.lostError()
+	keepaliveErr, ok := err.(*KeepaliveError)
+	if !ok || keepaliveErr.Addr != jump.addr() || keepaliveErr.Missed != KeepaliveCountMax {
+		t.Fatalf("got %v, want a KeepaliveError of the jump host %s", err, jump.addr())
+	}
+	if exit := errorExit(err); exit.Reason != ExitKeepaliveTimeout {
+		t.Errorf("got exit reason %s, want %s", exit.Reason, ExitKeepaliveTimeout)
+	}
+	if _, _, err := conn.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+		t.Error("the target connection is still open")
+	}
+}
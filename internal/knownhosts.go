@@ -0,0 +1,290 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyMode decides what happens when a server presents a host key that is not in the store.
+type HostKeyMode string
+
+const (
+	// HostKeyTOFU trusts and records the key the first time a host is seen (trust on first use)
+	HostKeyTOFU HostKeyMode = "tofu"
+	// HostKeyStrict refuses unknown hosts, their keys are kept as pending until approved
+	HostKeyStrict HostKeyMode = "strict"
+	// HostKeyOff disables host key verification entirely
+	HostKeyOff HostKeyMode = "off"
+)
+
+// ParseHostKeyMode validates a host key mode given on the command line.
+func ParseHostKeyMode(mode string) (HostKeyMode, error) {
+	switch m := HostKeyMode(strings.ToLower(mode)); m {
+	case HostKeyTOFU, HostKeyStrict, HostKeyOff:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown host key mode '%s', expected one of tofu, strict, off", mode)
+	}
+}
+
+// HostKeyChangedError is returned when a host presents a key different from the one we know.
+type HostKeyChangedError struct {
+	Host        string
+	KeyType     string
+	Fingerprint string
+	Known       []string
+}
+
+func (e *HostKeyChangedError) Error() string {
+	return fmt.Sprintf("host key for %s has changed (got %s %s, known %s), the connection was refused, "+
+		"someone could be eavesdropping on you", e.Host, e.KeyType, e.Fingerprint, strings.Join(e.Known, ", "))
+}
+
+// HostKeyUnknownError is returned in strict mode when a host is not in the store yet.
+type HostKeyUnknownError struct {
+	Host        string
+	KeyType     string
+	Fingerprint string
+}
+
+func (e *HostKeyUnknownError) Error() string {
+	return fmt.Sprintf("host key for %s is unknown (%s %s), it must be approved before connecting",
+		e.Host, e.KeyType, e.Fingerprint)
+}
+
+// KnownHost is a single entry of the known_hosts file.
+type KnownHost struct {
+	Line        int      `json:"line"`
+	Marker      string   `json:"marker,omitempty"`
+	Hosts       []string `json:"hosts"`
+	KeyType     string   `json:"keyType"`
+	Fingerprint string   `json:"fingerprint"`
+	Comment     string   `json:"comment,omitempty"`
+}
+
+// PendingHostKey is a key we refused and which an administrator can approve.
+type PendingHostKey struct {
+	Host        string    `json:"host"`
+	KeyType     string    `json:"keyType"`
+	Fingerprint string    `json:"fingerprint"`
+	Changed     bool      `json:"changed"`
+	SeenAt      time.Time `json:"seenAt"`
+	key         ssh.PublicKey
+}
+
+// KnownHostsStore is a file backed (OpenSSH format) host key database.
+type KnownHostsStore struct {
+	path    string
+	mode    HostKeyMode
+	lock    sync.Mutex
+	pending map[string]PendingHostKey
+}
+
+var knownHosts *KnownHostsStore
+
+// InitKnownHosts is called from main to set up the host key store, the file is created if it does not exist.
+func InitKnownHosts(path string, mode HostKeyMode) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_ = f.Close()
+	knownHosts = &KnownHostsStore{path: path, mode: mode, pending: make(map[string]PendingHostKey)}
+	return nil
+}
+
+// hostKeyCallback returns the callback used for every ssh dial.
+func hostKeyCallback() ssh.HostKeyCallback {
+	if knownHosts == nil {
+		return ssh.InsecureIgnoreHostKey()
+	}
+	return knownHosts.check
+}
+
+func (s *KnownHostsStore) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if s.mode == HostKeyOff {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	callback, err := knownhosts.New(s.path)
+	if err != nil {
+		return err
+	}
+	err = callback(hostname, remote, key)
+	keyErr, ok := err.(*knownhosts.KeyError)
+	if !ok {
+		return err
+	}
+	host := knownhosts.Normalize(hostname)
+	fingerprint := ssh.FingerprintSHA256(key)
+	if len(keyErr.Want) == 0 {
+		if s.mode == HostKeyTOFU {
+			return s.appendLine(knownhosts.Line([]string{hostname}, key))
+		}
+		s.pending[host] = PendingHostKey{Host: host, KeyType: key.Type(), Fingerprint: fingerprint, SeenAt: time.Now(), key: key}
+		return &HostKeyUnknownError{Host: host, KeyType: key.Type(), Fingerprint: fingerprint}
+	}
+	var known []string
+	for _, want := range keyErr.Want {
+		known = append(known, want.Key.Type()+" "+ssh.FingerprintSHA256(want.Key))
+	}
+	s.pending[host] = PendingHostKey{Host: host, KeyType: key.Type(), Fingerprint: fingerprint, Changed: true, SeenAt: time.Now(), key: key}
+	return &HostKeyChangedError{Host: host, KeyType: key.Type(), Fingerprint: fingerprint, Known: known}
+}
+
+func (s *KnownHostsStore) appendLine(line string) error {
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(line + "\n")
+	return err
+}
+
+// List returns the entries of the known_hosts file and the keys waiting for approval.
+func (s *KnownHostsStore) List() ([]KnownHost, []PendingHostKey, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	content, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	hosts := make([]KnownHost, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for n := 1; scanner.Scan(); n++ {
+		marker, names, key, comment, _, err := ssh.ParseKnownHosts(scanner.Bytes())
+		if err != nil {
+			continue
+		}
+		hosts = append(hosts, KnownHost{Line: n, Marker: marker, Hosts: names, KeyType: key.Type(),
+			Fingerprint: ssh.FingerprintSHA256(key), Comment: comment})
+	}
+	pending := make([]PendingHostKey, 0, len(s.pending))
+	for _, p := range s.pending {
+		pending = append(pending, p)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].SeenAt.Before(pending[j].SeenAt) })
+	return hosts, pending, nil
+}
+
+// Approve trusts a pending key, a changed key replaces every key previously known for that host.
+func (s *KnownHostsStore) Approve(host, fingerprint string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	host = knownhosts.Normalize(host)
+	p, ok := s.pending[host]
+	if !ok || p.Fingerprint != fingerprint {
+		return fmt.Errorf("no pending host key %s for %s", fingerprint, host)
+	}
+	if p.Changed {
+		if _, err := s.remove(host, ""); err != nil {
+			return err
+		}
+	}
+	if err := s.appendLine(knownhosts.Line([]string{host}, p.key)); err != nil {
+		return err
+	}
+	delete(s.pending, host)
+	return nil
+}
+
+// Revoke removes the keys of a host (all of them if fingerprint is empty), or a key from every host if host is empty.
+func (s *KnownHostsStore) Revoke(host, fingerprint string) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if host != "" {
+		host = knownhosts.Normalize(host)
+		delete(s.pending, host)
+	}
+	return s.remove(host, fingerprint)
+}
+
+// remove rewrites the known_hosts file without the matching entries, the caller must hold the lock.
+func (s *KnownHostsStore) remove(host, fingerprint string) (int, error) {
+	content, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		out     bytes.Buffer
+		removed int
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		marker, names, key, _, _, err := ssh.ParseKnownHosts([]byte(line))
+		if err != nil || (fingerprint != "" && ssh.FingerprintSHA256(key) != fingerprint) {
+			out.WriteString(line + "\n")
+			continue
+		}
+		if host == "" {
+			removed++
+			continue
+		}
+		var kept []string
+		for _, name := range names {
+			if !knownHostMatches(name, host) {
+				kept = append(kept, name)
+			}
+		}
+		if len(kept) == len(names) {
+			out.WriteString(line + "\n")
+			continue
+		}
+		removed++
+		if len(kept) > 0 {
+			newLine := knownhosts.Line(kept, key)
+			if marker != "" {
+				newLine = "@" + marker + " " + newLine
+			}
+			out.WriteString(newLine + "\n")
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, ioutil.WriteFile(s.path, out.Bytes(), 0600)
+}
+
+// knownHostMatches reports whether a host name of a known_hosts line is host. Hashed names
+// (HashKnownHosts yes) are |1|salt|hash, host is hashed with their salt to compare them.
+func knownHostMatches(name, host string) bool {
+	if !strings.HasPrefix(name, "|1|") {
+		return name == host
+	}
+	parts := strings.Split(name[len("|1|"):], "|")
+	if len(parts) != 2 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return hmac.Equal(mac.Sum(nil), hash)
+}
@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newTestHostKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newTestKnownHosts(t *testing.T, mode HostKeyMode) (*KnownHostsStore, func()) {
+	dir, err := ioutil.TempDir("", "knownhosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := knownHosts
+	if err := InitKnownHosts(filepath.Join(dir, "known_hosts"), mode); err != nil {
+		t.Fatal(err)
+	}
+	s := knownHosts
+	knownHosts = old
+	return s, func() { os.RemoveAll(dir) }
+}
+
+var testRemote = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+func TestKnownHostsTOFU(t *testing.T) {
+	s, cleanup := newTestKnownHosts(t, HostKeyTOFU)
+	defer cleanup()
+	key, other := newTestHostKey(t), newTestHostKey(t)
+
+	if err := s.check("10.0.0.1:22", testRemote, key); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := s.check("10.0.0.1:22", testRemote, key); err != nil {
+		t.Fatalf("same key: %v", err)
+	}
+	err := s.check("10.0.0.1:22", testRemote, other)
+	changed, ok := err.(*HostKeyChangedError)
+	if !ok {
+		t.Fatalf("changed key: got %v, want a HostKeyChangedError", err)
+	}
+	if len(changed.Known) != 1 || changed.Known[0] != key.Type()+" "+ssh.FingerprintSHA256(key) {
+		t.Errorf("got known keys %v", changed.Known)
+	}
+
+	hosts, pending, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 || hosts[0].Fingerprint != ssh.FingerprintSHA256(key) {
+		t.Errorf("got hosts %+v, want the first key only", hosts)
+	}
+	if len(pending) != 1 || !pending[0].Changed || pending[0].Fingerprint != ssh.FingerprintSHA256(other) {
+		t.Fatalf("got pending %+v, want the changed key", pending)
+	}
+
+	if err := s.Approve("10.0.0.1", "SHA256:wrong"); err == nil {
+		t.Error("approved a fingerprint that isn't pending")
+	}
+	if err := s.Approve("10.0.0.1", ssh.FingerprintSHA256(other)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.check("10.0.0.1:22", testRemote, other); err != nil {
+		t.Errorf("approved key: %v", err)
+	}
+	if err := s.check("10.0.0.1:22", testRemote, key); err == nil {
+		t.Error("the replaced key is still accepted")
+	}
+}
+
+func TestKnownHostsStrict(t *testing.T) {
+	s, cleanup := newTestKnownHosts(t, HostKeyStrict)
+	defer cleanup()
+	key := newTestHostKey(t)
+
+	if _, ok := s.check("10.0.0.1:22", testRemote, key).(*HostKeyUnknownError); !ok {
+		t.Fatal("strict mode accepted an unknown host")
+	}
+	if _, ok := s.check("10.0.0.1:22", testRemote, key).(*HostKeyUnknownError); !ok {
+		t.Fatal("strict mode recorded the key of an unknown host")
+	}
+	if err := s.Approve("10.0.0.1", ssh.FingerprintSHA256(key)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.check("10.0.0.1:22", testRemote, key); err != nil {
+		t.Fatalf("approved key: %v", err)
+	}
+	if _, pending, _ := s.List(); len(pending) != 0 {
+		t.Errorf("got pending %+v after approval", pending)
+	}
+
+	if n, err := s.Revoke("10.0.0.2", ""); err != nil || n != 0 {
+		t.Errorf("revoking an unknown host removed %d, %v", n, err)
+	}
+	if n, err := s.Revoke("10.0.0.1", ""); err != nil || n != 1 {
+		t.Fatalf("revoke removed %d, %v", n, err)
+	}
+	if _, ok := s.check("10.0.0.1:22", testRemote, key).(*HostKeyUnknownError); !ok {
+		t.Error("a revoked key is still accepted")
+	}
+}
+
+func TestKnownHostsRevokeFingerprint(t *testing.T) {
+	s, cleanup := newTestKnownHosts(t, HostKeyTOFU)
+	defer cleanup()
+	key, other := newTestHostKey(t), newTestHostKey(t)
+	for _, host := range []string{"10.0.0.1:22", "10.0.0.2:22"} {
+		if err := s.check(host, testRemote, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.check("10.0.0.3:22", testRemote, other); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.Revoke("", ssh.FingerprintSHA256(key)); err != nil || n != 2 {
+		t.Fatalf("revoke removed %d, %v, want both hosts of the key", n, err)
+	}
+	hosts, _, err := s.List()
+	if err != nil || len(hosts) != 1 || hosts[0].Hosts[0] != "10.0.0.3" {
+		t.Errorf("got hosts %+v, %v", hosts, err)
+	}
+}
+
+func TestKnownHostsRevokeHashed(t *testing.T) {
+	s, cleanup := newTestKnownHosts(t, HostKeyTOFU)
+	defer cleanup()
+	key := newTestHostKey(t)
+	lines := []string{
+		knownhosts.Line([]string{knownhosts.HashHostname("10.0.0.1")}, key),
+		knownhosts.Line([]string{knownhosts.HashHostname("[10.0.0.1]:2222")}, key),
+		knownhosts.Line([]string{"10.0.0.2", knownhosts.HashHostname("10.0.0.1")}, key),
+		knownhosts.Line([]string{knownhosts.HashHostname("10.0.0.3")}, key),
+	}
+	if err := ioutil.WriteFile(s.path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.Revoke("10.0.0.1:22", ""); err != nil || n != 2 {
+		t.Fatalf("revoke removed %d, %v, want both lines of the host", n, err)
+	}
+	hosts, _, err := s.List()
+	if err != nil || len(hosts) != 3 {
+		t.Fatalf("got hosts %+v, %v, want the other port and hosts kept", hosts, err)
+	}
+	if got := hosts[1].Hosts; len(got) != 1 || got[0] != "10.0.0.2" {
+		t.Errorf("got hosts %v, want the plain name kept", got)
+	}
+	// the revoked host is unknown again, the others are still trusted
+	other := newTestHostKey(t)
+	if err := s.check("10.0.0.1:22", testRemote, other); err != nil {
+		t.Errorf("the revoked host: %v", err)
+	}
+	for _, host := range []string{"10.0.0.1:2222", "10.0.0.3:22"} {
+		if _, ok := s.check(host, testRemote, other).(*HostKeyChangedError); !ok {
+			t.Errorf("%s: the hashed entry was revoked", host)
+		}
+	}
+}
+
+func TestKnownHostsOff(t *testing.T) {
+	s, cleanup := newTestKnownHosts(t, HostKeyOff)
+	defer cleanup()
+	if err := s.check("10.0.0.1:22", testRemote, newTestHostKey(t)); err != nil {
+		t.Fatal(err)
+	}
+	if hosts, _, _ := s.List(); len(hosts) != 0 {
+		t.Errorf("off mode recorded %+v", hosts)
+	}
+}
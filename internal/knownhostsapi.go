@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type KnownHostsResponse struct {
+	Mode    HostKeyMode      `json:"mode"`
+	Hosts   []KnownHost      `json:"hosts"`
+	Pending []PendingHostKey `json:"pending"`
+}
+
+type HostKeyRequest struct {
+	Host        string `json:"host"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// HandleListKnownHosts lists the trusted host keys and the keys waiting for approval
+func HandleListKnownHosts(context *gin.Context) {
+	if knownHosts == nil {
+		Fail("known hosts store is not configured", context)
+		return
+	}
+	hosts, pending, err := knownHosts.List()
+	if err != nil {
+		Fail(err.Error(), context)
+		return
+	}
+	SuccessWithData(KnownHostsResponse{Mode: knownHosts.mode, Hosts: hosts, Pending: pending}, context)
+}
+
+// HandleApproveKnownHost trusts a pending key, a changed key replaces the old ones
+func HandleApproveKnownHost(context *gin.Context) {
+	var req HostKeyRequest
+	if err := context.BindJSON(&req); err != nil || req.Host == "" || req.Fingerprint == "" {
+		context.JSON(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	if knownHosts == nil {
+		Fail("known hosts store is not configured", context)
+		return
+	}
+	if err := knownHosts.Approve(req.Host, req.Fingerprint); err != nil {
+		Fail(err.Error(), context)
+		return
+	}
+	Success(context)
+}
+
+// HandleRevokeKnownHost removes host keys by host, fingerprint or both and returns how many were removed
+func HandleRevokeKnownHost(context *gin.Context) {
+	host, fingerprint := context.Query("host"), context.Query("fingerprint")
+	if host == "" && fingerprint == "" {
+		context.JSON(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	if knownHosts == nil {
+		Fail("known hosts store is not configured", context)
+		return
+	}
+	removed, err := knownHosts.Revoke(host, fingerprint)
+	if err != nil {
+		Fail(err.Error(), context)
+		return
+	}
+	SuccessWithData(removed, context)
+}
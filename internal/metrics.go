@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	sessionsActive = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "web_terminal_sessions_active",
+		Help: "Terminals that have been bound, attached or waiting for a reconnect.",
+	}, func() float64 {
+		bound, _ := terminalSessions.count()
+		return float64(bound)
+	})
+	sessionsUnbound = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "web_terminal_sessions_unbound",
+		Help: "Terminals created but not bound by a browser yet.",
+	}, func() float64 {
+		_, unbound := terminalSessions.count()
+		return float64(unbound)
+	})
+	sshConnectionsOpen = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "web_terminal_ssh_connections",
+		Help: "Pooled SSH connections, each shared by the terminals to the same target.",
+	}, func() float64 {
+		return float64(sshConnections.Len())
+	})
+	sshDialSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "web_terminal_ssh_dial_seconds",
+		Help:    "Time to open the TCP connection to a host or jump host.",
+		Buckets: prometheus.DefBuckets,
+	})
+	sshAuthSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "web_terminal_ssh_auth_seconds",
+		Help:    "Time of the SSH handshake and authentication with a host or jump host.",
+		Buckets: prometheus.DefBuckets,
+	})
+	stdinBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "web_terminal_stdin_bytes_total",
+		Help: "Bytes of stdin sent to the remote processes.",
+	})
+	stdoutBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "web_terminal_stdout_bytes_total",
+		Help: "Bytes of output received from the remote processes.",
+	})
+	sessionFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "web_terminal_session_failures_total",
+		Help: "Terminals closed for another reason than their process exiting, by exit reason.",
+	}, []string{"reason"})
+	connectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "web_terminal_connections_total",
+		Help: "Connections attached to terminals, by transport.",
+	}, []string{"transport"})
+)
+
+func init() {
+	prometheus.MustRegister(sessionsActive, sessionsUnbound, sshConnectionsOpen, sshDialSeconds, sshAuthSeconds,
+		stdinBytes, stdoutBytes, sessionFailures, connectionsTotal)
+}
+
+// count returns how many sessions have been bound and how many still wait for their first bind
+func (sm *SessionMap) count() (bound, unbound int) {
+	sm.Lock.RLock()
+	defer sm.Lock.RUnlock()
+	for _, terminalSession := range sm.Sessions {
+		if atomic.LoadInt64(&terminalSession.boundAt) != 0 {
+			bound++
+		} else {
+			unbound++
+		}
+	}
+	return bound, unbound
+}
+
+var metricsHandler = promhttp.Handler()
+
+func HandleMetrics(context *gin.Context) {
+	metricsHandler.ServeHTTP(context.Writer, context.Request)
+}
@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"bufio"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// scrapeMetrics reads the metrics endpoint, series without a sample are missing from the map
+func scrapeMetrics(t *testing.T) map[string]float64 {
+	recorder := httptest.NewRecorder()
+	context, _ := gin.CreateTestContext(recorder)
+	context.Request = httptest.NewRequest("GET", "/metrics", nil)
+	HandleMetrics(context)
+	metrics := make(map[string]float64)
+	scanner := bufio.NewScanner(recorder.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("can't parse %q: %v", line, err)
+		}
+		metrics[line[:i]] = value
+	}
+	return metrics
+}
+
+func TestMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const (
+		unbound    = "web_terminal_sessions_unbound"
+		active     = "web_terminal_sessions_active"
+		stdout     = "web_terminal_stdout_bytes_total"
+		connection = `web_terminal_connections_total{transport="sockjs/xhr_streaming"}`
+		killed     = `web_terminal_session_failures_total{reason="killed_by_admin"}`
+		exited     = `web_terminal_session_failures_total{reason="process_exited"}`
+	)
+	before := scrapeMetrics(t)
+
+	alice := &Principal{Name: "alice"}
+	terminalSession := newTerminalSession("metrics-test", alice, Host{}, nil)
+	terminalSessions.Set(terminalSession.id, terminalSession)
+	defer terminalSessions.Close(terminalSession.id, TerminalExit{Reason: ExitProcessExited})
+	if got := scrapeMetrics(t); got[unbound] != before[unbound]+1 || got[active] != before[active] {
+		t.Errorf("got %v unbound and %v active, want one more unbound", got[unbound], got[active])
+	}
+
+	conn := newTestSockJSSession("metrics")
+	defer close(conn.recv)
+	transport := sockJSTransport("/v1/sockjs/123/abcdef/xhr_streaming")
+	if _, _, err := terminalSessions.Bind(terminalSession.id, "", alice, newSockJSConn(conn, "", transport)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := terminalSession.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	got := scrapeMetrics(t)
+	if got[unbound] != before[unbound] || got[active] != before[active]+1 {
+		t.Errorf("got %v unbound and %v active after the bind, want one more active", got[unbound], got[active])
+	}
+	if got[stdout] != before[stdout]+5 || got[connection] != before[connection]+1 {
+		t.Errorf("got %v stdout bytes and %v %s connections", got[stdout], got[connection], transport)
+	}
+
+	terminalSessions.Close(terminalSession.id, TerminalExit{Status: closeReaped, Reason: ExitKilledByAdmin})
+	got = scrapeMetrics(t)
+	if got[active] != before[active] || got[killed] != before[killed]+1 {
+		t.Errorf("got %v active and %v killed after the kill", got[active], got[killed])
+	}
+	if _, ok := got[exited]; ok {
+		t.Error("a process that exited is counted as a failure")
+	}
+}
@@ -0,0 +1,235 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TargetPolicy decides which hosts the server may open ssh connections to. It is loaded from a
+// JSON file, every list is optional:
+//
+//	{
+//	  "allowCidrs": ["10.0.0.0/8"],        // if set, every resolved address must be in one of them
+//	  "denyCidrs":  ["10.0.0.0/24"],       // resolved addresses that are always refused
+//	  "allowHosts": ["*.prod.example.com"], // if set, host names must match one of the patterns
+//	  "denyHosts":  ["vault.*"],           // host names that are always refused
+//	  "ports":      ["22", "2200-2299"]    // if set, the port must be in one of the ranges
+//	}
+type TargetPolicy struct {
+	AllowCIDRs []string `json:"allowCidrs"`
+	DenyCIDRs  []string `json:"denyCidrs"`
+	AllowHosts []string `json:"allowHosts"`
+	DenyHosts  []string `json:"denyHosts"`
+	Ports      []string `json:"ports"`
+
+	allow []*net.IPNet
+	deny  []*net.IPNet
+	ports [][2]int
+}
+
+// defaultDenyCIDRs are refused when no policy file is given: loopback, link-local (cloud metadata
+// services live at 169.254.169.254) and unspecified addresses
+var defaultDenyCIDRs = []string{"127.0.0.0/8", "::1/128", "169.254.0.0/16", "fe80::/10", "0.0.0.0/8", "::/128"}
+
+var targetPolicy = mustCompilePolicy(&TargetPolicy{DenyCIDRs: defaultDenyCIDRs})
+
+// TargetBlockedError is returned when the policy refuses a target
+type TargetBlockedError struct {
+	Target string
+	Reason string
+}
+
+func (e *TargetBlockedError) Error() string {
+	return fmt.Sprintf("target %s is not allowed: %s", e.Target, e.Reason)
+}
+
+func mustCompilePolicy(p *TargetPolicy) *TargetPolicy {
+	if err := p.compile(); err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// InitTargetPolicy is called from main to load the policy file, the default policy is kept when path is empty
+func InitTargetPolicy(path string) error {
+	if path == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var p TargetPolicy
+	if err := json.Unmarshal(content, &p); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if err := p.compile(); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	targetPolicy = &p
+	return nil
+}
+
+func (p *TargetPolicy) compile() error {
+	parse := func(cidrs []string) ([]*net.IPNet, error) {
+		var nets []*net.IPNet
+		for _, cidr := range cidrs {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, ipNet)
+		}
+		return nets, nil
+	}
+	var err error
+	if p.allow, err = parse(p.AllowCIDRs); err != nil {
+		return err
+	}
+	if p.deny, err = parse(p.DenyCIDRs); err != nil {
+		return err
+	}
+	for _, pattern := range append(append([]string{}, p.AllowHosts...), p.DenyHosts...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad host pattern '%s': %v", pattern, err)
+		}
+	}
+	p.ports = nil
+	for _, r := range p.Ports {
+		bounds := strings.SplitN(r, "-", 2)
+		from, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return fmt.Errorf("bad port range '%s'", r)
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil {
+				return fmt.Errorf("bad port range '%s'", r)
+			}
+		}
+		if from < 1 || to > 65535 || from > to {
+			return fmt.Errorf("bad port range '%s', ports must be 1-65535 and low <= high", r)
+		}
+		p.ports = append(p.ports, [2]int{from, to})
+	}
+	return nil
+}
+
+func matchAny(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *TargetPolicy) checkIP(target string, ip net.IP) error {
+	for _, ipNet := range p.deny {
+		if ipNet.Contains(ip) {
+			return &TargetBlockedError{Target: target, Reason: fmt.Sprintf("address %s is in denied range %s", ip, ipNet)}
+		}
+	}
+	if len(p.allow) == 0 {
+		return nil
+	}
+	for _, ipNet := range p.allow {
+		if ipNet.Contains(ip) {
+			return nil
+		}
+	}
+	return &TargetBlockedError{Target: target, Reason: fmt.Sprintf("address %s is not in an allowed range", ip)}
+}
+
+// checkName checks everything that can be decided without resolving the host
+func (p *TargetPolicy) checkName(host string, port int) error {
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+	if len(p.ports) > 0 {
+		allowed := false
+		for _, r := range p.ports {
+			if port >= r[0] && port <= r[1] {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &TargetBlockedError{Target: target, Reason: fmt.Sprintf("port %d is not allowed", port)}
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return p.checkIP(target, ip)
+	}
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	if matchAny(p.DenyHosts, name) {
+		return &TargetBlockedError{Target: target, Reason: "host name is denied"}
+	}
+	if len(p.AllowHosts) > 0 && !matchAny(p.AllowHosts, name) {
+		return &TargetBlockedError{Target: target, Reason: "host name is not allowed"}
+	}
+	return nil
+}
+
+// Check checks a target reached through a jump host, the jump host resolves its name so only
+// the name, the port and literal addresses can be checked
+func (p *TargetPolicy) Check(host string, port int) error {
+	return p.checkName(host, port)
+}
+
+// Resolve checks a target the server dials itself and returns the address to dial. Every address
+// the name resolves to must be allowed, and the address that was checked is the one dialed, so
+// the name can't be re-pointed somewhere else between the check and the connection.
+func (p *TargetPolicy) Resolve(host string, port int) (string, error) {
+	if err := p.checkName(host, port); err != nil {
+		return "", err
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("no address found for %s", host)
+	}
+	for _, ip := range ips {
+		if err := p.checkIP(target, ip); err != nil {
+			return "", err
+		}
+	}
+	return net.JoinHostPort(ips[0].String(), strconv.Itoa(port)), nil
+}
+
+// checkTarget checks the whole chain of a terminal before it is created
+func checkTarget(host Host) error {
+	hops := append(append([]Host{}, host.Jumps...), host)
+	for i, hop := range hops {
+		port := hop.Port
+		if port == 0 {
+			port = 22
+		}
+		var err error
+		if i == 0 {
+			_, err = targetPolicy.Resolve(hop.Ip, port)
+		} else {
+			err = targetPolicy.Check(hop.Ip, port)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dialTarget opens the tcp connection of the first hop, re-checking the policy right before dialing
+func dialTarget(host string, port int, timeout time.Duration) (net.Conn, error) {
+	addr, err := targetPolicy.Resolve(host, port)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialTimeout("tcp", addr, timeout)
+}
@@ -0,0 +1,97 @@
+package internal
+
+import "testing"
+
+func TestTargetPolicyCheck(t *testing.T) {
+	policy := mustCompilePolicy(&TargetPolicy{
+		AllowCIDRs: []string{"10.0.0.0/8"},
+		DenyCIDRs:  []string{"10.0.0.0/24"},
+		AllowHosts: []string{"*.prod.example.com"},
+		DenyHosts:  []string{"vault.*"},
+		Ports:      []string{"22", "2200-2299"},
+	})
+	tests := []struct {
+		host    string
+		port    int
+		allowed bool
+	}{
+		{"10.1.2.3", 22, true},
+		{"10.1.2.3", 2222, true},
+		{"10.1.2.3", 2300, false},
+		{"10.1.2.3", 80, false},
+		{"10.0.0.5", 22, false},
+		{"192.168.1.1", 22, false},
+		{"web.prod.example.com", 22, true},
+		{"WEB.Prod.Example.com.", 22, true},
+		{"web.dev.example.com", 22, false},
+		{"vault.prod.example.com", 22, false},
+	}
+	for _, tt := range tests {
+		err := policy.Check(tt.host, tt.port)
+		if tt.allowed && err != nil {
+			t.Errorf("%s:%d: %v", tt.host, tt.port, err)
+		}
+		if !tt.allowed {
+			if _, ok := err.(*TargetBlockedError); !ok {
+				t.Errorf("%s:%d: got %v, want a TargetBlockedError", tt.host, tt.port, err)
+			}
+		}
+	}
+}
+
+func TestDefaultPolicy(t *testing.T) {
+	policy := mustCompilePolicy(&TargetPolicy{DenyCIDRs: defaultDenyCIDRs})
+	for _, host := range []string{"127.0.0.1", "::1", "169.254.169.254", "fe80::1", "0.0.0.0", "::"} {
+		if err := policy.Check(host, 22); err == nil {
+			t.Errorf("%s is allowed by the default policy", host)
+		}
+	}
+	for _, host := range []string{"10.1.2.3", "192.168.1.1", "8.8.8.8"} {
+		if err := policy.Check(host, 22); err != nil {
+			t.Errorf("%s: %v", host, err)
+		}
+	}
+}
+
+func TestTargetPolicyResolve(t *testing.T) {
+	policy := mustCompilePolicy(&TargetPolicy{DenyCIDRs: defaultDenyCIDRs})
+	tests := []struct {
+		host string
+		want string // empty when the target must be refused
+	}{
+		{"10.1.2.3", "10.1.2.3:22"},
+		{"2001:db8::1", "[2001:db8::1]:22"},
+		{"127.0.0.1", ""},
+		// the name resolves to loopback, it must not slip past the address check
+		{"localhost", ""},
+	}
+	for _, tt := range tests {
+		got, err := policy.Resolve(tt.host, 22)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: resolved to %s, want an error", tt.host, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.host, got, err, tt.want)
+		}
+	}
+}
+
+func TestCompilePolicyErrors(t *testing.T) {
+	for _, p := range []*TargetPolicy{
+		{AllowCIDRs: []string{"10.0.0.0"}},
+		{DenyCIDRs: []string{"not a cidr"}},
+		{AllowHosts: []string{"["}},
+		{Ports: []string{"ssh"}},
+		{Ports: []string{"22-x"}},
+		{Ports: []string{"2299-2200"}},
+		{Ports: []string{"0"}},
+		{Ports: []string{"22-70000"}},
+	} {
+		if err := p.compile(); err == nil {
+			t.Errorf("%+v compiled without an error", p)
+		}
+	}
+}
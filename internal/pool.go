@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// pooledConnection is an ssh connection shared by every terminal to the same target
+type pooledConnection struct {
+	conn *sshConnection
+	refs int
+}
+
+// connectionPool keeps one ssh connection per target, each terminal opens its own ssh.Session on
+// it. The connection is closed when the last terminal releases it.
+type connectionPool struct {
+	lock  sync.Mutex
+	conns map[string]*pooledConnection
+}
+
+var sshConnections = &connectionPool{conns: make(map[string]*pooledConnection)}
+
+// poolKey identifies the target of host: user, address and credentials of every hop, the ssh-agent
+// included. The credentials are hashed so they never sit in the pool in clear.
+func poolKey(host Host) string {
+	var hops []string
+	for _, hop := range append(append([]Host{}, host.Jumps...), host) {
+		port := hop.Port
+		if port == 0 {
+			port = 22
+		}
+		secret := sha256.Sum256([]byte(hop.Password + "\x00" + hop.PrivateKey + "\x00" + hop.Passphrase))
+		key := fmt.Sprintf("%s@%s:%d#%s", hop.Username, hop.Ip, port, hex.EncodeToString(secret[:8]))
+		if hop.useAgent {
+			// a connection logged in with the agent must not be lent to a principal without it
+			key += "+agent"
+		}
+		hops = append(hops, key)
+	}
+	return strings.Join(hops, ",")
+}
+
+// Acquire returns the pooled connection to host, dialing it with sshConnect when there is none.
+// release must be called once the caller is done with it, the connection must not be closed
+// directly.
+func (p *connectionPool) Acquire(host Host) (conn *sshConnection, release func(), err error) {
+	key := poolKey(host)
+	p.lock.Lock()
+	pooled, ok := p.conns[key]
+	if ok {
+		pooled.refs++
+	}
+	p.lock.Unlock()
+
+	if !ok {
+		if conn, err = sshConnect(host); err != nil {
+			return nil, nil, err
+		}
+		p.lock.Lock()
+		if pooled, ok = p.conns[key]; ok {
+			// dialed at the same time as another terminal, keep the one already in the pool
+			pooled.refs++
+			_ = conn.Close()
+		} else {
+			pooled = &pooledConnection{conn: conn, refs: 1}
+			p.conns[key] = pooled
+			go p.watch(key, pooled)
+		}
+		p.lock.Unlock()
+	}
+
+	var once sync.Once
+	return pooled.conn, func() {
+		once.Do(func() { p.release(key, pooled) })
+	}, nil
+}
+
+func (p *connectionPool) release(key string, pooled *pooledConnection) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if pooled.refs--; pooled.refs > 0 {
+		return
+	}
+	if p.conns[key] == pooled {
+		delete(p.conns, key)
+	}
+	_ = pooled.conn.Close()
+}
+
+// watch drops a connection from the pool once it is gone, so the next terminal dials again
+// instead of failing on a dead connection
+func (p *connectionPool) watch(key string, pooled *pooledConnection) {
+	_ = pooled.conn.Wait()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.conns[key] == pooled {
+		delete(p.conns, key)
+	}
+}
+
+// Len returns how many connections are open
+func (p *connectionPool) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.conns)
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPoolKey(t *testing.T) {
+	host := Host{Ip: "10.0.0.1", Username: "deploy", Password: "secret"}
+	withPort := host
+	withPort.Port = 22
+	if poolKey(host) != poolKey(withPort) {
+		t.Error("the default port gives another key")
+	}
+	for _, other := range []Host{
+		{Ip: "10.0.0.1", Username: "deploy", Password: "other"},
+		{Ip: "10.0.0.1", Username: "root", Password: "secret"},
+		{Ip: "10.0.0.1", Port: 2222, Username: "deploy", Password: "secret"},
+		{Ip: "10.0.0.1", Username: "deploy", Password: "secret", Jumps: []Host{{Ip: "10.0.0.2", Username: "jump"}}},
+		{Ip: "10.0.0.1", Username: "deploy", Password: "secret", useAgent: true},
+	} {
+		if poolKey(other) == poolKey(host) {
+			t.Errorf("%+v shares the connection of %+v", other, host)
+		}
+	}
+	if key := poolKey(host); strings.Contains(key, "secret") {
+		t.Errorf("the key %s contains the password", key)
+	}
+}
+
+func TestConnectionPoolRefcount(t *testing.T) {
+	defer withLoopbackPolicy()()
+	server := newTestSSHServer(t)
+	defer server.listener.Close()
+	pool := &connectionPool{conns: make(map[string]*pooledConnection)}
+
+	first, releaseFirst, err := pool.Acquire(server.host())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, releaseSecond, err := pool.Acquire(server.host())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("two terminals to the same target got different connections")
+	}
+	// the server registers a connection a moment after the client is through
+	waitFor(t, "the server to see the connection", func() bool { n, _ := server.dials(); return n == 1 })
+	if n, _ := server.dials(); n != 1 || pool.Len() != 1 {
+		t.Fatalf("got %d dials and %d pooled connections, want 1", n, pool.Len())
+	}
+
+	// a release called twice must not drop the reference of the other terminal
+	releaseFirst()
+	releaseFirst()
+	if pool.Len() != 1 {
+		t.Fatal("the connection was closed while a terminal still uses it")
+	}
+	if _, _, err := second.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		t.Fatalf("the shared connection is dead: %v", err)
+	}
+
+	releaseSecond()
+	if pool.Len() != 0 {
+		t.Fatal("the connection stayed pooled after the last release")
+	}
+	if _, _, err := second.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+		t.Error("the connection is still open after the last release")
+	}
+
+	other := server.host()
+	other.Password = "wrong"
+	if _, _, err := pool.Acquire(other); err == nil {
+		t.Error("a wrong password got the pooled connection")
+	}
+}
+
+func TestConnectionPoolEvict(t *testing.T) {
+	defer withLoopbackPolicy()()
+	server := newTestSSHServer(t)
+	defer server.listener.Close()
+	pool := &connectionPool{conns: make(map[string]*pooledConnection)}
+
+	_, releaseDead, err := pool.Acquire(server.host())
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the server to see the connection", func() bool { n, _ := server.dials(); return n == 1 })
+	_, serverConn := server.dials()
+	_ = serverConn.Close()
+	waitFor(t, "the dead connection to leave the pool", func() bool { return pool.Len() == 0 })
+
+	conn, release, err := pool.Acquire(server.host())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	waitFor(t, "a new connection after the first one died", func() bool { n, _ := server.dials(); return n == 2 })
+	// the terminal of the dead connection lets go of it late, the new one must stay
+	releaseDead()
+	if pool.Len() != 1 {
+		t.Fatal("releasing the dead connection evicted its replacement")
+	}
+	if _, _, err := conn.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		t.Fatalf("the new connection is dead: %v", err)
+	}
+}
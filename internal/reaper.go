@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// reapInterval is how often the reaper walks the SessionMap
+const reapInterval = 5 * time.Second
+
+// expiredSession is a session picked by the reaper together with the exit sent to the client
+type expiredSession struct {
+	id   string
+	exit TerminalExit
+}
+
+func reapedExit(reason ExitReason, format string, args ...interface{}) TerminalExit {
+	return TerminalExit{Status: closeReaped, Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
+
+// expired returns the sessions that were never bound within bindTimeout, lost their connection
+// for longer than reconnectGrace or had no stdin/stdout for idleTimeout. A zero bind or idle
+// timeout disables the corresponding check, a zero grace closes lost sessions right away.
+func (sm *SessionMap) expired(now time.Time, bindTimeout, reconnectGrace, idleTimeout time.Duration) []expiredSession {
+	sm.Lock.RLock()
+	defer sm.Lock.RUnlock()
+
+	var sessions []expiredSession
+	for id, session := range sm.Sessions {
+		if atomic.LoadInt64(&session.boundAt) == 0 {
+			if bindTimeout > 0 && now.Sub(session.createdAt) > bindTimeout {
+				sessions = append(sessions, expiredSession{id: id,
+					exit: reapedExit(ExitBindTimeout, "Session was not connected within %v", bindTimeout)})
+			}
+			continue
+		}
+		if detachedAt := session.detachedSince(); !detachedAt.IsZero() && now.Sub(detachedAt) >= reconnectGrace {
+			sessions = append(sessions, expiredSession{id: id,
+				exit: reapedExit(ExitReconnectTimeout, "Connection was lost for more than %v", reconnectGrace)})
+			continue
+		}
+		lastActivity := time.Unix(0, atomic.LoadInt64(&session.lastActivity))
+		if idleTimeout > 0 && now.Sub(lastActivity) > idleTimeout {
+			sessions = append(sessions, expiredSession{id: id,
+				exit: reapedExit(ExitIdleTimeout, "Session was idle for more than %v", idleTimeout)})
+		}
+	}
+	return sessions
+}
+
+// endIdleTransfers ends the file transfers that moved no data for transferIdleTimeout, the terminals
+// are taken out of the map first so the session lock is never taken under the map lock
+func (sm *SessionMap) endIdleTransfers(now time.Time) {
+	sm.Lock.RLock()
+	sessions := make([]*TerminalSession, 0, len(sm.Sessions))
+	for _, session := range sm.Sessions {
+		sessions = append(sessions, session)
+	}
+	sm.Lock.RUnlock()
+	for _, session := range sessions {
+		session.endIdleTransfer(now)
+	}
+}
+
+// StartSessionReaper closes terminals that were never bound within bindTimeout, stayed detached
+// longer than reconnectGrace, or saw no input or output for idleTimeout (0 disables it). It also
+// ends file transfers left without data for transferIdleTimeout.
+func StartSessionReaper(bindTimeout, reconnectGrace, idleTimeout time.Duration) {
+	go func() {
+		ticker := time.NewTicker(reapInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			reap(now, bindTimeout, reconnectGrace, idleTimeout)
+		}
+	}()
+}
+
+// reap closes the expired sessions, a panic only skips this round
+func reap(now time.Time, bindTimeout, reconnectGrace, idleTimeout time.Duration) {
+	defer recoverSession("")
+	for _, session := range terminalSessions.expired(now, bindTimeout, reconnectGrace, idleTimeout) {
+		terminalSessions.Close(session.id, session.exit)
+	}
+	terminalSessions.endIdleTransfers(now)
+}
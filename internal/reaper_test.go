@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSessionMapExpired(t *testing.T) {
+	now := time.Now()
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+	bound := ago(time.Hour).UnixNano()
+	sm := &SessionMap{Sessions: map[string]*TerminalSession{
+		"fresh":       {createdAt: ago(time.Second)},
+		"never-bound": {createdAt: ago(2 * time.Minute)},
+		"active":      {createdAt: ago(time.Hour), boundAt: bound, lastActivity: ago(time.Minute).UnixNano()},
+		"idle":        {createdAt: ago(time.Hour), boundAt: bound, lastActivity: ago(31 * time.Minute).UnixNano()},
+		"reconnecting": {createdAt: ago(time.Hour), boundAt: bound, lastActivity: ago(time.Minute).UnixNano(),
+			detachedAt: ago(10 * time.Second)},
+		"lost": {createdAt: ago(time.Hour), boundAt: bound, lastActivity: ago(time.Minute).UnixNano(),
+			detachedAt: ago(2 * time.Minute)},
+	}}
+	tests := []struct {
+		name                  string
+		bind, reconnect, idle time.Duration
+		want                  []string
+	}{
+		{"all", time.Minute, time.Minute, 30 * time.Minute, []string{"idle", "lost", "never-bound"}},
+		{"no idle timeout", time.Minute, time.Minute, 0, []string{"lost", "never-bound"}},
+		{"no bind timeout", 0, time.Minute, 30 * time.Minute, []string{"idle", "lost"}},
+		{"no reconnect grace", time.Hour, 0, 2 * time.Hour, []string{"lost", "reconnecting"}},
+		{"long timeouts", time.Hour, time.Hour, 2 * time.Hour, nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, s := range sm.expired(now, tt.bind, tt.reconnect, tt.idle) {
+			got = append(got, s.id)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	reasons := map[string]ExitReason{"never-bound": ExitBindTimeout, "lost": ExitReconnectTimeout, "idle": ExitIdleTimeout}
+	for _, s := range sm.expired(now, time.Minute, time.Minute, 30*time.Minute) {
+		if s.exit.Reason != reasons[s.id] || s.exit.Status != closeReaped {
+			t.Errorf("%s: got exit %+v, want reason %s", s.id, s.exit, reasons[s.id])
+		}
+	}
+}
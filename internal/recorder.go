@@ -0,0 +1,272 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	// RecordDir is where asciicast recordings are written, recording is disabled when empty
+	RecordDir string
+	// RecordMaxSize is the size in bytes after which a recording is rotated to a new part
+	RecordMaxSize int64 = 64 << 20
+)
+
+// asciicastHeader is the first line of an asciicast v2 file
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     uint16            `json:"width"`
+	Height    uint16            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// RecordingMeta is kept next to the asciicast files of a recording as <id>.json
+type RecordingMeta struct {
+	Id          string     `json:"id"`
+	Principal   string     `json:"principal"`
+	User        string     `json:"user"`
+	Host        string     `json:"host"`
+	Start       time.Time  `json:"start"`
+	End         *time.Time `json:"end,omitempty"`
+	ExitReason  ExitReason `json:"exitReason,omitempty"`
+	ExitMessage string     `json:"exitMessage,omitempty"`
+	Bytes       int64      `json:"bytes"`
+	Parts       int        `json:"parts"`
+	PartOffsets []float64  `json:"partOffsets"` // seconds from Start to the header of each part
+}
+
+// Recorder writes the output, input and resize events of a terminal to asciicast v2 files.
+// A nil Recorder records nothing so callers don't have to check whether recording is enabled.
+type Recorder struct {
+	lock    sync.Mutex
+	id      string
+	meta    RecordingMeta
+	title   string
+	width   uint16
+	height  uint16
+	part    int
+	start   time.Time
+	file    *os.File
+	written int64
+	stopped bool // closed or failed, later events are dropped
+	output  utf8Joiner
+	input   utf8Joiner
+}
+
+// genRecordingId generates a recording id that sorts by creation time
+func genRecordingId() (string, error) {
+	random, err := genTerminalSessionId()
+	if err != nil {
+		return "", err
+	}
+	return time.Now().Format("20060102-150405") + "-" + random[:8], nil
+}
+
+// newRecorder returns a recorder for a new terminal, or nil when recording is disabled
+func newRecorder(principal *Principal, user, host string) (*Recorder, error) {
+	if RecordDir == "" {
+		return nil, nil
+	}
+	id, err := genRecordingId()
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{
+		id:     id,
+		meta:   RecordingMeta{Id: id, Principal: principal.Name, User: user, Host: host, PartOffsets: make([]float64, 0)},
+		title:  fmt.Sprintf("%s@%s", user, host),
+		width:  defaultPtyCols,
+		height: defaultPtyRows,
+	}, nil
+}
+
+// ID returns the recording id, empty when not recording
+func (r *Recorder) ID() string {
+	if r == nil {
+		return ""
+	}
+	return r.id
+}
+
+// metaPath returns the metadata file of a recording
+func metaPath(id string) string {
+	return filepath.Join(RecordDir, id+".json")
+}
+
+// partPath returns the file of the n-th part of a recording, the first part has no suffix
+func partPath(id string, part int) string {
+	if part == 0 {
+		return filepath.Join(RecordDir, id+".cast")
+	}
+	return filepath.Join(RecordDir, fmt.Sprintf("%s.%d.cast", id, part))
+}
+
+// openPart starts a new file with its own header at start, the caller must hold the lock
+func (r *Recorder) openPart(start time.Time) error {
+	if err := os.MkdirAll(RecordDir, 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(partPath(r.id, r.part), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	r.file, r.written, r.start = f, 0, start
+	if r.part == 0 {
+		r.meta.Start = r.start
+	}
+	r.meta.Parts++
+	r.meta.PartOffsets = append(r.meta.PartOffsets, r.start.Sub(r.meta.Start).Seconds())
+	if err := r.writeMeta(); err != nil {
+		return err
+	}
+	header, err := json.Marshal(asciicastHeader{
+		Version:   2,
+		Width:     r.width,
+		Height:    r.height,
+		Timestamp: r.start.Unix(),
+		Title:     r.title,
+		Env:       map[string]string{"TERM": "xterm"},
+	})
+	if err != nil {
+		return err
+	}
+	return r.writeLine(header)
+}
+
+func (r *Recorder) writeLine(line []byte) error {
+	n, err := r.file.Write(append(line, '\n'))
+	r.written += int64(n)
+	r.meta.Bytes += int64(n)
+	return err
+}
+
+// writeMeta replaces the metadata file, the caller must hold the lock
+func (r *Recorder) writeMeta() error {
+	content, err := json.MarshalIndent(r.meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := metaPath(r.id) + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, metaPath(r.id))
+}
+
+// closePart closes the current file, the caller must hold the lock
+func (r *Recorder) closePart() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// event appends one [time, code, data] line, rotating to a new part when the file is too big.
+// With a joiner, an incomplete UTF-8 character at the end of p waits for the next event.
+func (r *Recorder) event(code string, p []byte, joiner *utf8Joiner) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stopped {
+		return
+	}
+	if joiner != nil {
+		if p = joiner.Join(p); len(p) == 0 {
+			return
+		}
+	}
+	data := string(p)
+
+	err := func() error {
+		now := time.Now()
+		if r.file == nil {
+			if err := r.openPart(now); err != nil {
+				return err
+			}
+		}
+		line, err := json.Marshal(castEvent{Time: now.Sub(r.start).Seconds(), Code: code, Data: data})
+		if err != nil {
+			return err
+		}
+		if RecordMaxSize > 0 && r.written+int64(len(line)) > RecordMaxSize {
+			if err := r.closePart(); err != nil {
+				return err
+			}
+			r.part++
+			if err := r.openPart(now); err != nil {
+				return err
+			}
+			if line, err = json.Marshal(castEvent{Time: now.Sub(r.start).Seconds(), Code: code, Data: data}); err != nil {
+				return err
+			}
+		}
+		return r.writeLine(line)
+	}()
+	if err != nil {
+		// 录像失败不影响终端本身，记录日志后停止录像
+		glog.Errorf("recorder %s: %v, recording stopped", r.id, err)
+		r.stopped = true
+		_ = r.closePart()
+	}
+}
+
+// Output records process output
+func (r *Recorder) Output(p []byte) {
+	if r == nil {
+		return
+	}
+	r.event("o", p, &r.output)
+}
+
+// Input records keystrokes sent to the process
+func (r *Recorder) Input(p []byte) {
+	if r == nil {
+		return
+	}
+	r.event("i", p, &r.input)
+}
+
+// Resize records a terminal size change, later parts start with the latest size
+func (r *Recorder) Resize(size *TerminalSize) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	r.width, r.height = size.Width, size.Height
+	r.lock.Unlock()
+	r.event("r", []byte(fmt.Sprintf("%dx%d", size.Width, size.Height)), nil)
+}
+
+// Finish ends the recording and stores why the terminal was closed
+func (r *Recorder) Finish(exit TerminalExit) error {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.meta.Start.IsZero() || r.meta.End != nil { //没有录到任何内容或者已经结束
+		r.stopped = true
+		return nil
+	}
+	r.stopped = true
+	err := r.closePart()
+	end := time.Now()
+	r.meta.End, r.meta.ExitReason, r.meta.ExitMessage = &end, exit.Reason, exit.Message
+	if merr := r.writeMeta(); err == nil {
+		err = merr
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// readCast returns the header and the events of one part of a recording
+func readCast(t *testing.T, path string) (asciicastHeader, [][]interface{}) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var (
+		header asciicastHeader
+		events [][]interface{}
+	)
+	scanner := bufio.NewScanner(f)
+	for first := true; scanner.Scan(); first = false {
+		if first {
+			if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+				t.Fatalf("%s: header: %v", path, err)
+			}
+			continue
+		}
+		var event []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || len(event) != 3 {
+			t.Fatalf("%s: event %q: %v", path, scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	return header, events
+}
+
+func TestRecorderRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(dir string, size int64) { RecordDir, RecordMaxSize = dir, size }(RecordDir, RecordMaxSize)
+	RecordDir, RecordMaxSize = dir, 300
+
+	r, err := newRecorder(&Principal{Name: "alice"}, "deploy", "web")
+	if err != nil || r == nil {
+		t.Fatalf("got %v, %v, want a recorder", r, err)
+	}
+	r.Resize(&TerminalSize{Width: 100, Height: 30})
+	r.Input([]byte("ls\r"))
+	var output []string
+	for i := 0; i < 20; i++ {
+		line := strings.Repeat("x", 20) + "\r\n"
+		output = append(output, line)
+		r.Output([]byte(line))
+	}
+	if err := r.Finish(TerminalExit{Reason: ExitProcessExited, Message: "Process exited"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		got   string
+		parts int
+	)
+	for ; ; parts++ {
+		path := partPath(r.ID(), parts)
+		fi, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > RecordMaxSize {
+			t.Errorf("part %d has %d bytes, more than %d", parts, fi.Size(), RecordMaxSize)
+		}
+		header, events := readCast(t, path)
+		if header.Version != 2 || header.Title != "deploy@web" {
+			t.Errorf("part %d: got header %+v", parts, header)
+		}
+		// every part starts with the size the terminal had when it was opened
+		if parts > 0 && (header.Width != 100 || header.Height != 30) {
+			t.Errorf("part %d: got size %dx%d, want 100x30", parts, header.Width, header.Height)
+		}
+		for _, event := range events {
+			if event[1] == "o" {
+				got += event[2].(string)
+			}
+		}
+	}
+	if parts < 2 {
+		t.Fatalf("got %d parts, want the recording rotated", parts)
+	}
+	if want := strings.Join(output, ""); got != want {
+		t.Errorf("the parts hold the output\n%q\nwant\n%q", got, want)
+	}
+
+	meta, err := LoadRecordingMeta(r.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Parts != parts || len(meta.PartOffsets) != parts || meta.Principal != "alice" || meta.User != "deploy" || meta.Host != "web" {
+		t.Errorf("got metadata %+v, want %d parts of deploy@web by alice", meta, parts)
+	}
+	if meta.End == nil || meta.ExitReason != ExitProcessExited || meta.ExitMessage != "Process exited" {
+		t.Errorf("got end %v and reason %q (%q), want the recording finished", meta.End, meta.ExitReason, meta.ExitMessage)
+	}
+}
+
+func TestRecorderDisabled(t *testing.T) {
+	defer func(dir string) { RecordDir = dir }(RecordDir)
+	RecordDir = ""
+	r, err := newRecorder(&Principal{Name: "alice"}, "deploy", "web")
+	if err != nil || r != nil {
+		t.Fatalf("got %v, %v, want no recorder", r, err)
+	}
+}
+
+// recording is disabled by default, the terminal then calls every method on a nil recorder
+func TestNilRecorder(t *testing.T) {
+	var r *Recorder
+	r.Output([]byte("output"))
+	r.Input([]byte("input"))
+	r.Resize(&TerminalSize{Width: 80, Height: 24})
+	if err := r.Finish(TerminalExit{Reason: ExitProcessExited}); err != nil {
+		t.Fatal(err)
+	}
+	if id := r.ID(); id != "" {
+		t.Fatalf("got id %q, want none", id)
+	}
+}
@@ -0,0 +1,236 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// replayMaxIdle caps the pauses of a replay so nobody waits for minutes of inactivity
+const replayMaxIdle = 3 * time.Second
+
+var recordingIdPattern = regexp.MustCompile(`^[0-9]{8}-[0-9]{6}-[0-9a-f]{8}$`)
+
+// castEvent is one [time, code, data] line of an asciicast v2 file
+type castEvent struct {
+	Time float64
+	Code string
+	Data string
+}
+
+func (e castEvent) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{e.Time, e.Code, e.Data})
+}
+
+func (e *castEvent) UnmarshalJSON(b []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if len(raw) != 3 {
+		return fmt.Errorf("asciicast event must have 3 elements, got %d", len(raw))
+	}
+	if err := json.Unmarshal(raw[0], &e.Time); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw[1], &e.Code); err != nil {
+		return err
+	}
+	return json.Unmarshal(raw[2], &e.Data)
+}
+
+// LoadRecordingMeta reads the metadata of a recording
+func LoadRecordingMeta(id string) (*RecordingMeta, error) {
+	if RecordDir == "" {
+		return nil, fmt.Errorf("recording is not enabled")
+	}
+	if !recordingIdPattern.MatchString(id) {
+		return nil, fmt.Errorf("invalid recording id '%s'", id)
+	}
+	content, err := ioutil.ReadFile(metaPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("can't find recording '%s'", id)
+		}
+		return nil, err
+	}
+	var meta RecordingMeta
+	if err := json.Unmarshal(content, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// ListRecordings returns the metadata of the recordings principal may see, newest first
+func ListRecordings(principal *Principal) ([]RecordingMeta, error) {
+	if RecordDir == "" {
+		return nil, fmt.Errorf("recording is not enabled")
+	}
+	files, err := ioutil.ReadDir(RecordDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return make([]RecordingMeta, 0), nil
+		}
+		return nil, err
+	}
+	recordings := make([]RecordingMeta, 0)
+	for _, f := range files {
+		id := strings.TrimSuffix(f.Name(), ".json")
+		if f.IsDir() || id == f.Name() || !recordingIdPattern.MatchString(id) {
+			continue
+		}
+		meta, err := LoadRecordingMeta(id)
+		if err != nil || !principal.allowed(meta.Principal) {
+			continue
+		}
+		recordings = append(recordings, *meta)
+	}
+	sort.Slice(recordings, func(i, j int) bool { return recordings[i].Start.After(recordings[j].Start) })
+	return recordings, nil
+}
+
+// readRecording calls header once with the header of the first part, then fn for every event of
+// every part with the time shifted to be relative to the start of the recording
+func readRecording(meta *RecordingMeta, header func(asciicastHeader) error, fn func(castEvent) error) error {
+	for part := 0; part < meta.Parts; part++ {
+		f, err := os.Open(partPath(meta.Id, part))
+		if err != nil {
+			return err
+		}
+		err = readPart(f, func(line []byte, first bool) error {
+			if first {
+				if part > 0 {
+					return nil
+				}
+				var h asciicastHeader
+				if err := json.Unmarshal(line, &h); err != nil {
+					return err
+				}
+				return header(h)
+			}
+			var e castEvent
+			if err := json.Unmarshal(line, &e); err != nil {
+				return err
+			}
+			if part < len(meta.PartOffsets) {
+				e.Time += meta.PartOffsets[part]
+			}
+			return fn(e)
+		})
+		_ = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readPart(r io.Reader, fn func(line []byte, first bool) error) error {
+	reader := bufio.NewReader(r)
+	for first := true; ; first = false {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 1 {
+			if ferr := fn(line, first); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// WriteRecording writes all the parts of a recording to w as a single asciicast v2 stream
+func WriteRecording(meta *RecordingMeta, w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	return readRecording(meta, func(h asciicastHeader) error {
+		return encoder.Encode(h)
+	}, func(e castEvent) error {
+		return encoder.Encode(e)
+	})
+}
+
+// ParseReplaySpeed validates the replay speed sent by the client, 0 means 1x
+func ParseReplaySpeed(speed float64) (float64, error) {
+	switch speed {
+	case 0:
+		return 1, nil
+	case 1, 2, 4:
+		return speed, nil
+	default:
+		return 0, fmt.Errorf("unsupported replay speed %v, expected 1, 2 or 4", speed)
+	}
+}
+
+// replayRecording plays a recording back in its own timing, output as stdout and size changes as
+// resize messages, input is not replayed
+func replayRecording(conn terminalConn, principal *Principal, id string, speed float64) {
+	meta, err := LoadRecordingMeta(id)
+	if err == nil && !principal.allowed(meta.Principal) {
+		err = fmt.Errorf("recording '%s' belongs to another principal", id)
+	}
+	if err == nil {
+		speed, err = ParseReplaySpeed(speed)
+	}
+	if err != nil {
+		_ = conn.Close(closeError, err.Error())
+		return
+	}
+
+	// 浏览器关闭连接后停止回放
+	closed := make(chan struct{})
+	go func() {
+		defer recoverSession("")
+		for {
+			if _, err := conn.Recv(); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+
+	var last float64
+	err = readRecording(meta, func(h asciicastHeader) error {
+		return conn.SendMessage(TerminalMessage{Op: "resize", Cols: h.Width, Rows: h.Height})
+	}, func(e castEvent) error {
+		delay := time.Duration((e.Time - last) / speed * float64(time.Second))
+		if delay > replayMaxIdle {
+			delay = replayMaxIdle
+		}
+		last = e.Time
+		select {
+		case <-closed:
+			return io.EOF
+		case <-time.After(delay):
+		}
+		switch e.Code {
+		case "o":
+			return conn.SendStdout([]byte(e.Data))
+		case "r":
+			var size TerminalSize
+			if _, err := fmt.Sscanf(e.Data, "%dx%d", &size.Width, &size.Height); err != nil {
+				return nil
+			}
+			return conn.SendMessage(TerminalMessage{Op: "resize", Cols: size.Width, Rows: size.Height})
+		}
+		return nil
+	})
+	if err == io.EOF {
+		return
+	}
+	if err != nil {
+		_ = conn.Close(closeError, err.Error())
+		return
+	}
+	_ = conn.Close(closeProcessExited, "Replay finished")
+}
@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// newTestRecording records a terminal that is resized once and rotated into several parts
+func newTestRecording(t *testing.T, principal *Principal) (*Recorder, string) {
+	r, err := newRecorder(principal, "deploy", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output string
+	for i := 0; i < 10; i++ {
+		if i == 5 {
+			r.Resize(&TerminalSize{Width: 100, Height: 30})
+		}
+		line := strings.Repeat("x", 20) + "\r\n"
+		output += line
+		r.Output([]byte(line))
+		r.Input([]byte("\r"))
+	}
+	if err := r.Finish(TerminalExit{Reason: ExitProcessExited, Message: "Process exited"}); err != nil {
+		t.Fatal(err)
+	}
+	return r, output
+}
+
+func withTestRecordDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDir, oldSize := RecordDir, RecordMaxSize
+	RecordDir, RecordMaxSize = dir, 300
+	return func() {
+		RecordDir, RecordMaxSize = oldDir, oldSize
+		os.RemoveAll(dir)
+	}
+}
+
+var alice, bob = &Principal{Name: "alice"}, &Principal{Name: "bob"}
+
+func TestWriteRecording(t *testing.T) {
+	defer withTestRecordDir(t)()
+	r, output := newTestRecording(t, alice)
+	meta, err := LoadRecordingMeta(r.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Parts < 2 {
+		t.Fatalf("got %d parts, want the recording rotated", meta.Parts)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteRecording(meta, &buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	var header asciicastHeader
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil || header.Version != 2 {
+		t.Fatalf("got header %q, %v", lines[0], err)
+	}
+	var (
+		got  string
+		last float64
+	)
+	for _, line := range lines[1:] {
+		var e castEvent
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("%q: %v, want one header followed by events", line, err)
+		}
+		// the events of later parts are shifted to the start of the recording
+		if e.Time < last {
+			t.Errorf("event at %v after one at %v", e.Time, last)
+		}
+		last = e.Time
+		if e.Code == "o" {
+			got += e.Data
+		}
+	}
+	if got != output {
+		t.Errorf("got output %q, want %q", got, output)
+	}
+}
+
+func TestListRecordings(t *testing.T) {
+	defer withTestRecordDir(t)()
+	first, _ := newTestRecording(t, alice)
+	second, _ := newTestRecording(t, alice)
+	if err := ioutil.WriteFile(metaPath("not-a-recording"), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	recordings, err := ListRecordings(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recordings) != 2 || recordings[0].Id != second.ID() || recordings[1].Id != first.ID() {
+		t.Errorf("got %+v, want the second recording then the first", recordings)
+	}
+	if recordings, err := ListRecordings(bob); err != nil || len(recordings) != 0 {
+		t.Errorf("bob lists %+v, %v", recordings, err)
+	}
+	if recordings, err := ListRecordings(&Principal{Name: "root", Admin: true}); err != nil || len(recordings) != 2 {
+		t.Errorf("an administrator lists %+v, %v", recordings, err)
+	}
+	for _, id := range []string{"../" + first.ID(), "20261016-000000-00000000"} {
+		if _, err := LoadRecordingMeta(id); err == nil {
+			t.Errorf("%s: loaded", id)
+		}
+	}
+}
+
+func TestReplayRecording(t *testing.T) {
+	defer withTestRecordDir(t)()
+	r, output := newTestRecording(t, alice)
+
+	session := newTestSockJSSession("replay")
+	defer close(session.recv)
+	replayRecording(newSockJSConn(session, "127.0.0.1", TransportSockJS), alice, r.ID(), 4)
+
+	var (
+		got   string
+		sizes []TerminalSize
+	)
+	for _, msg := range session.sent {
+		switch msg.Op {
+		case "stdout":
+			got += msg.Data
+		case "resize":
+			sizes = append(sizes, TerminalSize{Width: msg.Cols, Height: msg.Rows})
+		default:
+			t.Errorf("replayed a %s message", msg.Op)
+		}
+	}
+	if got != output {
+		t.Errorf("replayed %q, want %q", got, output)
+	}
+	if len(sizes) != 2 || sizes[0] != (TerminalSize{Width: defaultPtyCols, Height: defaultPtyRows}) ||
+		sizes[1] != (TerminalSize{Width: 100, Height: 30}) {
+		t.Errorf("got sizes %v, want the size of the header then 100x30", sizes)
+	}
+	if !session.closed || session.status != 1 {
+		t.Errorf("got closed %v with status %d, want the replay finished", session.closed, session.status)
+	}
+
+	for _, tt := range []struct {
+		principal *Principal
+		speed     float64
+	}{{alice, 3}, {alice, -1}, {bob, 1}} {
+		session := newTestSockJSSession("replay")
+		replayRecording(newSockJSConn(session, "127.0.0.1", TransportSockJS), tt.principal, r.ID(), tt.speed)
+		close(session.recv)
+		if len(session.sent) != 0 || session.status != 2 {
+			t.Errorf("%s at speed %v: sent %v and closed with %d, want an error", tt.principal.Name, tt.speed, session.sent, session.status)
+		}
+	}
+}
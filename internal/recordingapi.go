@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/glog"
+)
+
+// HandleListRecordings lists the recordings, newest first
+func HandleListRecordings(context *gin.Context) {
+	recordings, err := ListRecordings(CurrentPrincipal(context))
+	if err != nil {
+		Fail(err.Error(), context)
+		return
+	}
+	SuccessWithData(recordings, context)
+}
+
+func HandleGetRecording(context *gin.Context) {
+	meta, err := loadOwnRecording(context)
+	if err != nil {
+		Fail(err.Error(), context)
+		return
+	}
+	SuccessWithData(meta, context)
+}
+
+// HandleDownloadRecording joins the parts of a recording into one asciicast file
+func HandleDownloadRecording(context *gin.Context) {
+	meta, err := loadOwnRecording(context)
+	if err != nil {
+		Fail(err.Error(), context)
+		return
+	}
+	context.Header("Content-Type", "application/x-asciicast")
+	context.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.cast"`, meta.Id))
+	context.Status(http.StatusOK)
+	if err := WriteRecording(meta, context.Writer); err != nil {
+		// 已经开始输出了，只能记录日志
+		glog.Errorf("download recording %s: %v", meta.Id, err)
+	}
+}
+
+// loadOwnRecording loads the recording of the request, only admins can see other principals' recordings
+func loadOwnRecording(context *gin.Context) (*RecordingMeta, error) {
+	meta, err := LoadRecordingMeta(context.Param("id"))
+	if err != nil {
+		return nil, err
+	}
+	if !CurrentPrincipal(context).allowed(meta.Principal) {
+		return nil, fmt.Errorf("recording '%s' belongs to another principal", meta.Id)
+	}
+	return meta, nil
+}
@@ -11,8 +11,9 @@ import (
 )
 
 const (
-    SUCCESS = 0
-    FAIL    = 500
+    SUCCESS        = 0
+    TARGET_BLOCKED = 403 // 目标主机被访问策略拒绝
+    FAIL           = 500
 )
 
 // 快捷成功输出  {"state":200,"message":"执行成功","data":null}
@@ -41,3 +42,12 @@ func Fail(err string, c *gin.Context) {
         "data":    nil,
     })
 }
+
+// 带错误码的失败输出      {"code":403,"message":"target ... is not allowed","data":nil}
+func FailWithCode(code int, err string, c *gin.Context) {
+    c.JSON(http.StatusOK, gin.H{
+        "code":    code,
+        "message": err,
+        "data":    nil,
+    })
+}
@@ -0,0 +1,92 @@
+package internal
+
+import "unicode/utf8"
+
+// ringBuffer keeps the last size bytes written to it
+type ringBuffer struct {
+	buf  []byte
+	pos  int
+	full bool
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{buf: make([]byte, size)}
+}
+
+// Write appends p, overwriting the oldest bytes once the buffer is full
+func (r *ringBuffer) Write(p []byte) {
+	size := len(r.buf)
+	if size == 0 {
+		return
+	}
+	if len(p) >= size {
+		copy(r.buf, p[len(p)-size:])
+		r.pos, r.full = 0, true
+		return
+	}
+	n := copy(r.buf[r.pos:], p)
+	if n < len(p) {
+		copy(r.buf, p[n:])
+		r.full = true
+	}
+	r.pos = (r.pos + len(p)) % size
+	if r.pos == 0 {
+		r.full = true
+	}
+}
+
+// Bytes returns a copy of the buffered bytes, oldest first
+func (r *ringBuffer) Bytes() []byte {
+	if !r.full {
+		return append([]byte(nil), r.buf[:r.pos]...)
+	}
+	return append(append([]byte(nil), r.buf[r.pos:]...), r.buf[:r.pos]...)
+}
+
+// trimPartialRune drops the continuation bytes left at the start of p when the oldest
+// bytes of a multi-byte character were overwritten
+func trimPartialRune(p []byte) []byte {
+	for i := 0; i < len(p) && i < utf8.UTFMax; i++ {
+		if utf8.RuneStart(p[i]) {
+			return p[i:]
+		}
+	}
+	return p
+}
+
+// utf8Joiner holds back an incomplete multi-byte character at the end of a chunk until the rest
+// of it arrives with the next chunk, so chunks can be turned into strings without producing
+// replacement characters
+type utf8Joiner struct {
+	partial []byte
+}
+
+// Join returns the held back bytes followed by p, minus a new incomplete character at the end.
+// The result may be p itself, it is only valid until the next call.
+func (j *utf8Joiner) Join(p []byte) []byte {
+	if len(j.partial) == 0 {
+		cut := incompleteTail(p)
+		if cut < len(p) {
+			j.partial = append(j.partial, p[cut:]...)
+		}
+		return p[:cut]
+	}
+	buf := append(j.partial, p...)
+	cut := incompleteTail(buf)
+	j.partial = append([]byte(nil), buf[cut:]...)
+	return buf[:cut]
+}
+
+// incompleteTail returns where the incomplete character at the end of p starts, len(p) when
+// p ends with a complete one
+func incompleteTail(p []byte) int {
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if utf8.FullRune(p[i:]) {
+				return len(p)
+			}
+			return i
+		}
+	}
+	return len(p)
+}
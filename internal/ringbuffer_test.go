@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRingBuffer(t *testing.T) {
+	tests := []struct {
+		size   int
+		writes []string
+		want   string
+	}{
+		{8, nil, ""},
+		{8, []string{"abc"}, "abc"},
+		{8, []string{"abc", "defgh"}, "abcdefgh"},
+		{8, []string{"abc", "defghij"}, "cdefghij"},
+		{8, []string{"abcdefghijkl"}, "efghijkl"},
+		{8, []string{"abcdef", "gh", "ij"}, "cdefghij"},
+		{0, []string{"abc"}, ""},
+	}
+	for _, tt := range tests {
+		r := newRingBuffer(tt.size)
+		for _, w := range tt.writes {
+			r.Write([]byte(w))
+		}
+		if got := string(r.Bytes()); got != tt.want {
+			t.Errorf("size %d, writes %q: got %q, want %q", tt.size, tt.writes, got, tt.want)
+		}
+	}
+}
+
+func TestRingBufferTrimPartialRune(t *testing.T) {
+	r := newRingBuffer(5)
+	r.Write([]byte("a世界")) // 7 bytes, the first byte of 世 is overwritten
+	if got := string(trimPartialRune(r.Bytes())); got != "界" {
+		t.Errorf("got %q, want %q", got, "界")
+	}
+}
+
+func TestUTF8Joiner(t *testing.T) {
+	text := []byte("héllo, 世界 🙂!")
+	// every way of cutting the text in two must give it back without replacement characters
+	for cut := 0; cut <= len(text); cut++ {
+		var j utf8Joiner
+		var got []byte
+		got = append(got, j.Join(append([]byte(nil), text[:cut]...))...)
+		got = append(got, j.Join(append([]byte(nil), text[cut:]...))...)
+		if !bytes.Equal(got, text) {
+			t.Errorf("cut at %d: got %q, want %q", cut, got, text)
+		}
+	}
+
+	var j utf8Joiner
+	emoji := []byte("🙂")
+	for i, b := range emoji[:len(emoji)-1] {
+		if got := j.Join([]byte{b}); len(got) != 0 {
+			t.Errorf("byte %d: got %q before the character is complete", i, got)
+		}
+	}
+	if got := j.Join(emoji[len(emoji)-1:]); !bytes.Equal(got, emoji) {
+		t.Errorf("got %q, want %q", got, emoji)
+	}
+}
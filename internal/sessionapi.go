@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ConnectionInfo describes one connection attached to a terminal
+type ConnectionInfo struct {
+	Id         string     `json:"id"`
+	Role       AttachRole `json:"role"`
+	Transport  string     `json:"transport"`
+	ClientIP   string     `json:"clientIp"`
+	AttachedAt time.Time  `json:"attachedAt"`
+}
+
+// SessionInfo is a snapshot of a live terminal for the admin API
+type SessionInfo struct {
+	Id           string           `json:"id"`
+	Principal    string           `json:"principal"`
+	Target       string           `json:"target"`
+	RecordingId  string           `json:"recordingId,omitempty"`
+	CreatedAt    time.Time        `json:"createdAt"`
+	BoundAt      *time.Time       `json:"boundAt"`      // nil until the first bind
+	LastActivity time.Time        `json:"lastActivity"` // last stdin or stdout
+	DetachedAt   *time.Time       `json:"detachedAt"`   // set while no connection is attached
+	BytesIn      int64            `json:"bytesIn"`
+	BytesOut     int64            `json:"bytesOut"`
+	Connections  []ConnectionInfo `json:"connections"`
+}
+
+// info takes a snapshot of the terminal
+func (t *TerminalSession) info() SessionInfo {
+	info := SessionInfo{
+		Id:           t.id,
+		Principal:    t.principal,
+		Target:       t.target,
+		RecordingId:  t.recorder.ID(),
+		CreatedAt:    t.createdAt,
+		LastActivity: time.Unix(0, atomic.LoadInt64(&t.lastActivity)),
+		BytesIn:      atomic.LoadInt64(&t.bytesIn),
+		BytesOut:     atomic.LoadInt64(&t.bytesOut),
+		Connections:  make([]ConnectionInfo, 0),
+	}
+	if boundAt := atomic.LoadInt64(&t.boundAt); boundAt != 0 {
+		bound := time.Unix(0, boundAt)
+		info.BoundAt = &bound
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.detachedAt.IsZero() {
+		detachedAt := t.detachedAt
+		info.DetachedAt = &detachedAt
+	}
+	for _, a := range t.attachments {
+		info.Connections = append(info.Connections, ConnectionInfo{
+			Id:         a.conn.ID(),
+			Role:       a.role,
+			Transport:  a.conn.Transport(),
+			ClientIP:   a.conn.ClientIP(),
+			AttachedAt: a.attachedAt,
+		})
+	}
+	sort.Slice(info.Connections, func(i, j int) bool {
+		return info.Connections[i].AttachedAt.Before(info.Connections[j].AttachedAt)
+	})
+	return info
+}
+
+// List returns a snapshot of every session, oldest first
+func (sm *SessionMap) List() []SessionInfo {
+	sm.Lock.RLock()
+	sessions := make([]*TerminalSession, 0, len(sm.Sessions))
+	for _, terminalSession := range sm.Sessions {
+		sessions = append(sessions, terminalSession)
+	}
+	sm.Lock.RUnlock()
+
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, terminalSession := range sessions {
+		infos = append(infos, terminalSession.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].CreatedAt.Before(infos[j].CreatedAt)
+	})
+	return infos
+}
+
+// HandleListSessions lists every live terminal, including those waiting for a bind or a reconnect
+func HandleListSessions(context *gin.Context) {
+	SuccessWithData(terminalSessions.List(), context)
+}
+
+func HandleGetSession(context *gin.Context) {
+	sessionId := context.Param("id")
+	terminalSession := terminalSessions.Get(sessionId)
+	if terminalSession == nil {
+		Fail(fmt.Sprintf("can't find session '%s'", sessionId), context)
+		return
+	}
+	SuccessWithData(terminalSession.info(), context)
+}
+
+type KillSessionRequest struct {
+	Reason string `json:"reason"`
+}
+
+// HandleKillSession closes a terminal, its connections get a killed_by_admin exit message with the
+// optional reason
+func HandleKillSession(context *gin.Context) {
+	var req KillSessionRequest
+	if context.Request.ContentLength > 0 {
+		if err := context.BindJSON(&req); err != nil {
+			return
+		}
+	}
+	sessionId := context.Param("id")
+	if terminalSessions.Get(sessionId) == nil {
+		Fail(fmt.Sprintf("can't find session '%s'", sessionId), context)
+		return
+	}
+	message := "Terminal closed by an administrator"
+	if req.Reason != "" {
+		message = fmt.Sprintf("%s: %s", message, req.Reason)
+	}
+	terminalSessions.Close(sessionId, TerminalExit{Status: closeReaped, Reason: ExitKilledByAdmin, Message: message})
+	Success(context)
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSessionMapList(t *testing.T) {
+	sm := &SessionMap{Sessions: make(map[string]*TerminalSession)}
+	alice, bob := &Principal{Name: "alice"}, &Principal{Name: "bob"}
+	waiting := newTerminalSession("list-waiting", alice, Host{Ip: "10.0.0.1", Port: 22, Username: "deploy"}, nil)
+	bound := newTerminalSession("list-bound", alice, Host{Ip: "10.0.0.2", Port: 22, Username: "root"}, nil)
+	bound.createdAt = waiting.createdAt.Add(time.Second)
+	sm.Set(waiting.id, waiting)
+	sm.Set(bound.id, bound)
+	defer sm.Close(waiting.id, TerminalExit{Reason: ExitProcessExited})
+	defer sm.Close(bound.id, TerminalExit{Reason: ExitProcessExited})
+
+	owner, watcher := newTestSockJSSession("owner"), newTestSockJSSession("watcher")
+	defer close(owner.recv)
+	defer close(watcher.recv)
+	if _, _, err := sm.Bind(bound.id, "", alice, newSockJSConn(owner, "192.0.2.1", TransportSockJS)); err != nil {
+		t.Fatal(err)
+	}
+	token, err := bound.share(RoleReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sm.Bind(bound.id, token, bob, newSockJSConn(watcher, "192.0.2.2", TransportSockJS)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bound.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	infos := sm.List()
+	if len(infos) != 2 || infos[0].Id != waiting.id || infos[1].Id != bound.id {
+		t.Fatalf("got %+v, want the waiting session then the bound one", infos)
+	}
+	if info := infos[0]; info.BoundAt != nil || info.DetachedAt != nil || len(info.Connections) != 0 || info.Principal != "alice" {
+		t.Errorf("the waiting session got %+v", info)
+	}
+	info := infos[1]
+	if info.BoundAt == nil || info.Target != "root@10.0.0.2:22" || info.BytesOut != 5 {
+		t.Errorf("the bound session got %+v", info)
+	}
+	if len(info.Connections) != 2 {
+		t.Fatalf("got connections %+v, want the owner and the watcher", info.Connections)
+	}
+	for i, want := range []ConnectionInfo{
+		{Id: "owner", Role: RoleOwner, Transport: TransportSockJS, ClientIP: "192.0.2.1"},
+		{Id: "watcher", Role: RoleReadOnly, Transport: TransportSockJS, ClientIP: "192.0.2.2"},
+	} {
+		got := info.Connections[i]
+		got.AttachedAt = time.Time{}
+		if got != want {
+			t.Errorf("connection %d: got %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestHandleKillSession(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	alice := &Principal{Name: "alice"}
+	terminalSession := newTerminalSession("kill-test", alice, Host{}, nil)
+	terminalSessions.Set(terminalSession.id, terminalSession)
+	defer terminalSessions.Close(terminalSession.id, TerminalExit{Reason: ExitProcessExited})
+	conn := newTestSockJSSession("kill")
+	defer close(conn.recv)
+	if _, _, err := terminalSessions.Bind(terminalSession.id, "", alice, newSockJSConn(conn, "", TransportSockJS)); err != nil {
+		t.Fatal(err)
+	}
+
+	kill := func(id, body string) map[string]interface{} {
+		recorder := httptest.NewRecorder()
+		context, _ := gin.CreateTestContext(recorder)
+		context.Params = gin.Params{{Key: "id", Value: id}}
+		context.Request = httptest.NewRequest("DELETE", "/v1/sessions/"+id, strings.NewReader(body))
+		HandleKillSession(context)
+		var resp map[string]interface{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := kill("missing", ""); resp["code"] != float64(FAIL) {
+		t.Errorf("killing a missing session got %v", resp)
+	}
+	if resp := kill(terminalSession.id, `{"reason":"maintenance"}`); resp["code"] != float64(SUCCESS) {
+		t.Fatalf("got %v", resp)
+	}
+	if terminalSessions.Get(terminalSession.id) != nil {
+		t.Fatal("the session is still open")
+	}
+	if len(conn.sent) != 1 || conn.sent[0].Op != "exit" || conn.sent[0].Reason != string(ExitKilledByAdmin) ||
+		!strings.HasSuffix(conn.sent[0].Data, ": maintenance") {
+		t.Errorf("got %+v, want a killed_by_admin exit with the reason", conn.sent)
+	}
+	if !conn.closed || conn.status != closeReaped {
+		t.Errorf("got closed %v with %d, want %d", conn.closed, conn.status, closeReaped)
+	}
+}
@@ -0,0 +1,376 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/sftp"
+)
+
+const sftpClientKey = "sftpClient"
+
+func (t *TerminalSession) setConnection(conn *sshConnection) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.conn = conn
+}
+
+// sftpClient returns the SFTP client of the terminal, opened on first use as a subsystem of the
+// SSH connection of the shell
+func (t *TerminalSession) sftpClient() (*sftp.Client, error) {
+	t.lock.Lock()
+	conn := t.conn
+	t.lock.Unlock()
+	if conn == nil {
+		return nil, fmt.Errorf("session '%s' is not connected yet", t.id)
+	}
+
+	t.sftpLock.Lock()
+	defer t.sftpLock.Unlock()
+	if t.sftp == nil {
+		client, err := sftp.NewClient(conn.Client)
+		if err != nil {
+			return nil, err
+		}
+		t.sftp = client
+	}
+	return t.sftp, nil
+}
+
+// closeSFTP closes the SFTP client of the terminal, its channel would otherwise stay open on a
+// connection shared with other terminals
+func (t *TerminalSession) closeSFTP() {
+	t.sftpLock.Lock()
+	defer t.sftpLock.Unlock()
+	if t.sftp != nil {
+		_ = t.sftp.Close()
+		t.sftp = nil
+	}
+}
+
+// SessionSFTP opens SFTP on the connection of a terminal, for its owner and administrators
+func SessionSFTP() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		sessionId := context.Param("id")
+		terminalSession := terminalSessions.Get(sessionId)
+		if terminalSession == nil {
+			Fail(fmt.Sprintf("can't find session '%s'", sessionId), context)
+			context.Abort()
+			return
+		}
+		if !CurrentPrincipal(context).allowed(terminalSession.principal) {
+			context.AbortWithStatusJSON(http.StatusForbidden, http.StatusText(http.StatusForbidden))
+			return
+		}
+		client, err := terminalSession.sftpClient()
+		if err != nil {
+			Fail(err.Error(), context)
+			context.Abort()
+			return
+		}
+		context.Set(sftpClientKey, client)
+		context.Next()
+	}
+}
+
+// hostSession finds a connected terminal of principal to the inventory host hostId
+func (sm *SessionMap) hostSession(hostId string, principal *Principal) *TerminalSession {
+	sm.Lock.RLock()
+	defer sm.Lock.RUnlock()
+	for _, terminalSession := range sm.Sessions {
+		if terminalSession.hostId != hostId || terminalSession.principal != principal.Name {
+			continue
+		}
+		terminalSession.lock.Lock()
+		connected := terminalSession.conn != nil
+		terminalSession.lock.Unlock()
+		if connected {
+			return terminalSession
+		}
+	}
+	return nil
+}
+
+// HostSFTP opens SFTP on an inventory host. A terminal of the principal to that host lends its
+// connection, otherwise one is taken from the pool with the login of the host and given back after the request.
+func HostSFTP() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		principal := CurrentPrincipal(context)
+		host := Host{HostId: context.Param("id")}
+		if err := resolveInventoryHost(&host, principal); err != nil {
+			Fail(err.Error(), context)
+			context.Abort()
+			return
+		}
+		if terminalSession := terminalSessions.hostSession(host.HostId, principal); terminalSession != nil {
+			client, err := terminalSession.sftpClient()
+			if err != nil {
+				Fail(err.Error(), context)
+				context.Abort()
+				return
+			}
+			context.Set(sftpClientKey, client)
+			context.Next()
+			return
+		}
+
+		if err := resolveCredentials(&host, principal); err != nil {
+			Fail(err.Error(), context)
+			context.Abort()
+			return
+		}
+		allowAgent(&host, principal)
+		if err := checkTarget(host); err != nil {
+			if _, ok := err.(*TargetBlockedError); ok {
+				FailWithCode(TARGET_BLOCKED, err.Error(), context)
+			} else {
+				Fail(err.Error(), context)
+			}
+			context.Abort()
+			return
+		}
+		conn, release, err := sshConnections.Acquire(host)
+		if err != nil {
+			Fail(err.Error(), context)
+			context.Abort()
+			return
+		}
+		defer release()
+		client, err := sftp.NewClient(conn.Client)
+		if err != nil {
+			Fail(err.Error(), context)
+			context.Abort()
+			return
+		}
+		defer client.Close()
+		context.Set(sftpClientKey, client)
+		context.Next()
+	}
+}
+
+func currentSFTP(context *gin.Context) *sftp.Client {
+	return context.MustGet(sftpClientKey).(*sftp.Client)
+}
+
+// SFTPFileInfo describes a remote file
+type SFTPFileInfo struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"` // permission bits in octal, e.g. "0644"
+	ModTime time.Time `json:"modTime"`
+	IsDir   bool      `json:"isDir"`
+	IsLink  bool      `json:"isLink"`
+}
+
+func newSFTPFileInfo(dir string, fi os.FileInfo) SFTPFileInfo {
+	return SFTPFileInfo{
+		Name:    fi.Name(),
+		Path:    path.Join(dir, fi.Name()),
+		Size:    fi.Size(),
+		Mode:    fmt.Sprintf("%04o", fi.Mode().Perm()),
+		ModTime: fi.ModTime(),
+		IsDir:   fi.IsDir(),
+		IsLink:  fi.Mode()&os.ModeSymlink != 0,
+	}
+}
+
+// sftpPath is the path query parameter, relative paths start at the home directory of the user
+func sftpPath(context *gin.Context) string {
+	if p := context.Query("path"); p != "" {
+		return p
+	}
+	return "."
+}
+
+// HandleSFTPList lists a directory, the home directory by default, directories first then by name
+func HandleSFTPList(context *gin.Context) {
+	dir := sftpPath(context)
+	entries, err := currentSFTP(context).ReadDir(dir)
+	if err != nil {
+		Fail(err.Error(), context)
+		return
+	}
+	files := make([]SFTPFileInfo, 0, len(entries))
+	for _, fi := range entries {
+		files = append(files, newSFTPFileInfo(dir, fi))
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].IsDir != files[j].IsDir {
+			return files[i].IsDir
+		}
+		return files[i].Name < files[j].Name
+	})
+	SuccessWithData(files, context)
+}
+
+func HandleSFTPStat(context *gin.Context) {
+	p := sftpPath(context)
+	fi, err := currentSFTP(context).Stat(p)
+	if err != nil {
+		Fail(err.Error(), context)
+		return
+	}
+	SuccessWithData(newSFTPFileInfo(path.Dir(p), fi), context)
+}
+
+// HandleSFTPDownload sends a file, Range requests resume a download
+func HandleSFTPDownload(context *gin.Context) {
+	p := context.Query("path")
+	if p == "" {
+		context.JSON(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	file, err := currentSFTP(context).Open(p)
+	if err != nil {
+		Fail(err.Error(), context)
+		return
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		Fail(err.Error(), context)
+		return
+	}
+	if fi.IsDir() {
+		Fail(fmt.Sprintf("'%s' is a directory", p), context)
+		return
+	}
+	context.Header("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(path.Base(p)))
+	http.ServeContent(context.Writer, context.Request, path.Base(p), fi.ModTime(), file)
+}
+
+// HandleSFTPUpload writes every file of the multipart form into the path directory (home by default),
+// existing files are overwritten
+func HandleSFTPUpload(context *gin.Context) {
+	reader, err := context.Request.MultipartReader()
+	if err != nil {
+		context.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	client := currentSFTP(context)
+	dir := sftpPath(context)
+	uploaded := make([]SFTPFileInfo, 0)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			context.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+		if part.FileName() == "" {
+			continue
+		}
+		name := path.Join(dir, path.Base(part.FileName()))
+		fi, err := sftpUpload(client, name, part)
+		if err != nil {
+			Fail(err.Error(), context)
+			return
+		}
+		uploaded = append(uploaded, newSFTPFileInfo(dir, fi))
+	}
+	SuccessWithData(uploaded, context)
+}
+
+// sftpUpload streams r into the remote file name
+func sftpUpload(client *sftp.Client, name string, r io.Reader) (os.FileInfo, error) {
+	file, err := client.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err := file.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	return file.Stat()
+}
+
+type SFTPMkdirRequest struct {
+	Path    string `json:"path"`
+	Parents bool   `json:"parents"` // 同时创建不存在的上级目录
+}
+
+func HandleSFTPMkdir(context *gin.Context) {
+	var req SFTPMkdirRequest
+	if err := context.BindJSON(&req); err != nil || req.Path == "" {
+		context.JSON(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	client := currentSFTP(context)
+	var err error
+	if req.Parents {
+		err = client.MkdirAll(req.Path)
+	} else {
+		err = client.Mkdir(req.Path)
+	}
+	if err != nil {
+		Fail(err.Error(), context)
+		return
+	}
+	Success(context)
+}
+
+type SFTPRenameRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func HandleSFTPRename(context *gin.Context) {
+	var req SFTPRenameRequest
+	if err := context.BindJSON(&req); err != nil || req.From == "" || req.To == "" {
+		context.JSON(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	if err := currentSFTP(context).Rename(req.From, req.To); err != nil {
+		Fail(err.Error(), context)
+		return
+	}
+	Success(context)
+}
+
+// HandleSFTPDelete removes a file or an empty directory
+func HandleSFTPDelete(context *gin.Context) {
+	p := context.Query("path")
+	if p == "" {
+		context.JSON(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	if err := currentSFTP(context).Remove(p); err != nil {
+		Fail(err.Error(), context)
+		return
+	}
+	Success(context)
+}
+
+type SFTPChmodRequest struct {
+	Path string `json:"path"`
+	Mode string `json:"mode"` // 八进制的权限，例如"0644"
+}
+
+func HandleSFTPChmod(context *gin.Context) {
+	var req SFTPChmodRequest
+	if err := context.BindJSON(&req); err != nil || req.Path == "" {
+		context.JSON(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	mode, err := strconv.ParseUint(req.Mode, 8, 32)
+	if err != nil || mode > 07777 {
+		context.JSON(http.StatusBadRequest, fmt.Sprintf("bad mode '%s', expected octal permissions like 0644", req.Mode))
+		return
+	}
+	if err := currentSFTP(context).Chmod(req.Path, os.FileMode(mode)); err != nil {
+		Fail(err.Error(), context)
+		return
+	}
+	Success(context)
+}
@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// allowedSignals are the signals the browser and the admin API may send to the remote process
+var allowedSignals = map[string]ssh.Signal{
+	"INT":  ssh.SIGINT,
+	"TERM": ssh.SIGTERM,
+	"KILL": ssh.SIGKILL,
+	"HUP":  ssh.SIGHUP,
+	"QUIT": ssh.SIGQUIT,
+}
+
+// ParseSignal accepts the signal names of allowedSignals, with or without the SIG prefix
+func ParseSignal(name string) (ssh.Signal, error) {
+	sig, ok := allowedSignals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return "", fmt.Errorf("signal '%s' is not allowed, expected INT, TERM, KILL, HUP or QUIT", name)
+	}
+	return sig, nil
+}
+
+// processHandler is implemented by pty handlers that control the process they are attached to
+type processHandler interface {
+	setProcess(session *ssh.Session)
+}
+
+func (t *TerminalSession) setProcess(session *ssh.Session) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.process = session
+	select {
+	case <-t.done: // closed while the shell was starting
+		_ = session.Close()
+	default:
+	}
+}
+
+// closeProcess closes the ssh session of the shell, the connection stays open for the other
+// terminals sharing it
+func (t *TerminalSession) closeProcess() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.process != nil {
+		_ = t.process.Close()
+	}
+}
+
+// Signal sends a whitelisted signal to the remote process. The ssh server decides whether it
+// honours it, OpenSSH only does since 7.9.
+func (t *TerminalSession) Signal(name string) error {
+	sig, err := ParseSignal(name)
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	process := t.process
+	t.lock.Unlock()
+	if process == nil {
+		return errors.New("the process has not been started yet")
+	}
+	return process.Signal(sig)
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		name string
+		want ssh.Signal
+	}{
+		{"INT", ssh.SIGINT},
+		{"sigterm", ssh.SIGTERM},
+		{"SIGKILL", ssh.SIGKILL},
+		{"hup", ssh.SIGHUP},
+		{"QUIT", ssh.SIGQUIT},
+	}
+	for _, tt := range tests {
+		if got, err := ParseSignal(tt.name); err != nil || got != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+	for _, name := range []string{"", "USR1", "STOP", "SIG", "9", "INT "} {
+		if _, err := ParseSignal(name); err == nil {
+			t.Errorf("%q: accepted", name)
+		}
+	}
+}
+
+// toasts returns the toast messages sent to the connection
+func (s *testSockJSSession) toasts() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var toasts []string
+	for _, msg := range s.sent {
+		if msg.Op == "toast" {
+			toasts = append(toasts, msg.Data)
+		}
+	}
+	return toasts
+}
+
+func TestSignalOp(t *testing.T) {
+	sm := &SessionMap{Sessions: make(map[string]*TerminalSession)}
+	alice, bob := &Principal{Name: "alice"}, &Principal{Name: "bob"}
+	terminalSession := newTerminalSession("signal-test", alice, Host{}, nil)
+	sm.Set(terminalSession.id, terminalSession)
+	defer sm.Close(terminalSession.id, TerminalExit{Reason: ExitProcessExited})
+
+	owner, watcher := newTestSockJSSession("owner"), newTestSockJSSession("watcher")
+	defer close(owner.recv)
+	defer close(watcher.recv)
+	if _, _, err := sm.Bind(terminalSession.id, "", alice, newSockJSConn(owner, "127.0.0.1", TransportSockJS)); err != nil {
+		t.Fatal(err)
+	}
+	token, err := terminalSession.share(RoleReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sm.Bind(terminalSession.id, token, bob, newSockJSConn(watcher, "127.0.0.1", TransportSockJS)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the pump has handled a message once it takes the next one
+	send := func(s *testSockJSSession, msg string) {
+		s.recv <- msg
+		s.recv <- `{"op":"noop"}`
+	}
+	send(watcher, `{"op":"signal","signal":"KILL"}`)
+	if toasts := watcher.toasts(); len(toasts) != 0 {
+		t.Errorf("the signal of a read-only connection was handled: %q", toasts)
+	}
+	send(owner, `{"op":"signal","signal":"USR1"}`)
+	send(owner, `{"op":"signal","signal":"INT"}`)
+	toasts := owner.toasts()
+	if len(toasts) != 2 || !strings.Contains(toasts[0], "not allowed") || !strings.Contains(toasts[1], "not been started") {
+		t.Errorf("got toasts %q, want the refused signal and the missing process", toasts)
+	}
+}
+
+func TestHandleSignalTerminal(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		id, body string
+		status   int
+	}{
+		{"missing", `{"signal":"STOP"}`, http.StatusBadRequest},
+		{"missing", `{"signal":"TERM"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		context, _ := gin.CreateTestContext(recorder)
+		context.Params = gin.Params{{Key: "id", Value: tt.id}}
+		context.Request = httptest.NewRequest("POST", "/v1/terminal/"+tt.id+"/signal", strings.NewReader(tt.body))
+		HandleSignalTerminal(context)
+		if recorder.Code != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.body, recorder.Code, tt.status)
+		}
+		if tt.status == http.StatusOK && !strings.Contains(recorder.Body.String(), `"code":500`) {
+			t.Errorf("%s: got %s, want a failure", tt.body, recorder.Body.String())
+		}
+	}
+}
@@ -1,48 +1,281 @@
 /**
- * 
+ *
  * @author inori
  * @create 2019-04-12 15:39
  */
 package internal
 
 import (
+    "errors"
     "fmt"
+    "github.com/golang/glog"
     "golang.org/x/crypto/ssh"
+    "golang.org/x/crypto/ssh/agent"
     "net"
+    "os"
+    "strings"
+    "sync"
     "time"
 )
 
-func sshConnect(user string, password string, host string, port int) (*ssh.Session, error) {
+// AuthError is returned by sshConnect when the server rejected every authentication method we offered.
+type AuthError struct {
+    User     string
+    Addr     string
+    Attempts []string
+    Err      error
+}
+
+func (e *AuthError) Error() string {
+    if len(e.Attempts) == 0 {
+        return fmt.Sprintf("ssh: authentication for %s@%s failed, no method was accepted by the server: %v", e.User, e.Addr, e.Err)
+    }
+    return fmt.Sprintf("ssh: authentication for %s@%s failed, server refused %s", e.User, e.Addr, strings.Join(e.Attempts, ", "))
+}
+
+// UnreachableError is returned by sshConnect when the tcp connection to a host can't be opened.
+type UnreachableError struct {
+    Addr string
+    Err  error
+}
+
+func (e *UnreachableError) Error() string {
+    return fmt.Sprintf("ssh: can't reach %s: %v", e.Addr, e.Err)
+}
+
+// authAttempts records which authentication methods the server actually asked us to try.
+type authAttempts struct {
+    methods []string
+}
+
+func (a *authAttempts) add(method string) {
+    for _, m := range a.methods {
+        if m == method {
+            return
+        }
+    }
+    a.methods = append(a.methods, method)
+}
+
+// agentAvailable reports whether an ssh-agent is reachable through SSH_AUTH_SOCK.
+func agentAvailable() bool {
+    return os.Getenv("SSH_AUTH_SOCK") != ""
+}
+
+// AgentForAll lets every principal log in with the keys of the server's ssh-agent. They belong to
+// the server and not to the caller, so by default only administrators may use them.
+var AgentForAll = false
+
+// allowAgent lets host and its jump hosts offer the keys of the ssh-agent when principal may use them.
+func allowAgent(host *Host, principal *Principal) {
+    allowed := agentAvailable() && (principal.Admin || AgentForAll)
+    host.useAgent = allowed
+    for i := range host.Jumps {
+        host.Jumps[i].useAgent = allowed
+    }
+}
+
+// authMethods offers the private key, then ssh-agent if allowAgent let the host use it, then the
+// password. x/crypto/ssh tries a method only once per name, so the key and the agent keys must share
+// one publickey method. The returned agent connection must be closed once the connection is up.
+func authMethods(host Host, attempts *authAttempts) ([]ssh.AuthMethod, net.Conn, error) {
+    var (
+        auth      []ssh.AuthMethod
+        signers   []ssh.Signer
+        sources   []string
+        agentConn net.Conn
+    )
+    if host.PrivateKey != "" {
+        var (
+            signer ssh.Signer
+            err    error
+        )
+        if host.Passphrase != "" {
+            signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(host.PrivateKey), []byte(host.Passphrase))
+        } else {
+            signer, err = ssh.ParsePrivateKey([]byte(host.PrivateKey))
+        }
+        if err != nil {
+            return nil, nil, fmt.Errorf("invalid private key: %v", err)
+        }
+        signers = append(signers, signer)
+        sources = append(sources, "private key")
+    }
+    var agentClient agent.Agent
+    if host.useAgent && agentAvailable() {
+        conn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+        if err == nil {
+            agentConn = conn
+            agentClient = agent.NewClient(conn)
+            sources = append(sources, "ssh-agent")
+        }
+    }
+    if len(sources) > 0 {
+        auth = append(auth, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+            attempts.add(fmt.Sprintf("publickey (%s)", strings.Join(sources, ", ")))
+            if agentClient == nil {
+                return signers, nil
+            }
+            agentSigners, err := agentClient.Signers()
+            if err != nil {
+                return signers, nil
+            }
+            return append(signers, agentSigners...), nil
+        }))
+    }
+    if host.Password != "" {
+        auth = append(auth, ssh.PasswordCallback(func() (string, error) {
+            attempts.add("password")
+            return host.Password, nil
+        }))
+    }
+    if len(auth) == 0 {
+        return nil, agentConn, errors.New("no authentication method available, a password, private key or ssh-agent is required")
+    }
+    return auth, agentConn, nil
+}
+
+// sshConnection is the client of the target host together with the jump hosts it was dialed through.
+type sshConnection struct {
+    *ssh.Client
+    hops []*ssh.Client
+
+    lock sync.Mutex // guards lost
+    lost error      // set when a keepalive closed the connection
+}
+
+// Close closes the target connection and then every jump host, innermost first.
+func (c *sshConnection) Close() error {
+    var err error
+    if c.Client != nil {
+        err = c.Client.Close()
+    }
+    for i := len(c.hops) - 1; i >= 0; i-- {
+        _ = c.hops[i].Close()
+    }
+    return err
+}
+
+// sshConnect connects to the target through its jump hosts in order, each hop dialed over the
+// connection of the previous one
+func sshConnect(host Host) (*sshConnection, error) {
+    conn := &sshConnection{}
+    var via *ssh.Client
+    for i, hop := range append(append([]Host{}, host.Jumps...), host) {
+        client, err := dialHost(hop, via)
+        if err != nil {
+            _ = conn.Close()
+            if i < len(host.Jumps) {
+                glog.Errorf("sshConnect: jump host %d (%s) failed: %v", i+1, hop.Ip, err)
+            }
+            return nil, err
+        }
+        if i < len(host.Jumps) {
+            conn.hops = append(conn.hops, client)
+        } else {
+            conn.Client = client
+        }
+        via = client
+        if KeepaliveInterval > 0 {
+            go conn.keepAlive(client, client.RemoteAddr().String())
+        }
+    }
+    return conn, nil
+}
+
+// dialHost opens an authenticated client to host, directly or through the already connected jump host via.
+func dialHost(host Host, via *ssh.Client) (*ssh.Client, error) {
     var (
         auth         []ssh.AuthMethod
+        agentConn    net.Conn
+        attempts     authAttempts
         addr         string
         clientConfig *ssh.ClientConfig
         client       *ssh.Client
-        session      *ssh.Session
         err          error
     )
     // get auth method
-    auth = make([]ssh.AuthMethod, 0)
-    auth = append(auth, ssh.Password(password))
+    auth, agentConn, err = authMethods(host, &attempts)
+    if agentConn != nil {
+        defer agentConn.Close()
+    }
+    if err != nil {
+        return nil, err
+    }
 
+    // ssh.Dial flattens the callback error into a string, keep it so the caller can tell a changed key apart
+    var hostKeyErr error
+    checkHostKey := hostKeyCallback()
     hostKeyCallbk := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-        return nil
+        hostKeyErr = checkHostKey(hostname, remote, key)
+        return hostKeyErr
     }
     clientConfig = &ssh.ClientConfig{
-        User:            user,
+        User:            host.Username,
         Auth:            auth,
         Timeout:         30 * time.Second,
         HostKeyCallback: hostKeyCallbk,
     }
     // connet to ssh
-    addr = fmt.Sprintf("%s:%d", host, port)
+    if host.Port == 0 {
+        host.Port = 22
+    }
+    addr = fmt.Sprintf("%s:%d", host.Ip, host.Port)
 
-    if client, err = ssh.Dial("tcp", addr, clientConfig); err != nil {
+    if via == nil {
+        client, err = dialDirect(host, addr, clientConfig)
+    } else if err = targetPolicy.Check(host.Ip, host.Port); err == nil {
+        client, err = dialThrough(via, addr, clientConfig)
+    }
+    if err != nil {
+        if _, ok := err.(*TargetBlockedError); ok {
+            return nil, err
+        }
+        if hostKeyErr != nil {
+            return nil, hostKeyErr
+        }
+        if strings.Contains(err.Error(), "unable to authenticate") {
+            return nil, &AuthError{User: host.Username, Addr: addr, Attempts: attempts.methods, Err: err}
+        }
         return nil, err
     }
-    // create session
-    if session, err = client.NewSession(); err != nil {
+    return client, nil
+}
+
+// dialDirect dials the first hop from the server itself, the policy decides which address is dialed
+// but the handshake still uses the host name so known_hosts entries keep matching the name
+func dialDirect(host Host, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+    start := time.Now()
+    netConn, err := dialTarget(host.Ip, host.Port, config.Timeout)
+    sshDialSeconds.Observe(time.Since(start).Seconds())
+    if err != nil {
+        if _, ok := err.(*TargetBlockedError); ok {
+            return nil, err
+        }
+        return nil, &UnreachableError{Addr: addr, Err: err}
+    }
+    return newClient(netConn, addr, config)
+}
+
+// dialThrough runs the ssh handshake over a direct-tcpip channel of the previous hop.
+func dialThrough(via *ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+    start := time.Now()
+    netConn, err := via.Dial("tcp", addr)
+    sshDialSeconds.Observe(time.Since(start).Seconds())
+    if err != nil {
+        return nil, &UnreachableError{Addr: addr, Err: fmt.Errorf("through jump host %s: %v", via.RemoteAddr(), err)}
+    }
+    return newClient(netConn, addr, config)
+}
+
+// newClient runs the ssh handshake and authentication over netConn
+func newClient(netConn net.Conn, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+    start := time.Now()
+    c, chans, reqs, err := ssh.NewClientConn(netConn, addr, config)
+    sshAuthSeconds.Observe(time.Since(start).Seconds())
+    if err != nil {
+        _ = netConn.Close()
         return nil, err
     }
-    return session, nil
+    return ssh.NewClient(c, chans, reqs), nil
 }
@@ -0,0 +1,350 @@
+package internal
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// testSSHServer accepts password logins on a loopback port, counts the connections and opens
+// direct-tcpip channels like a jump host
+type testSSHServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+
+	lock   sync.Mutex
+	conns  []*ssh.ServerConn
+	dialed []string
+	muted  bool // global requests go unanswered like on a dead peer
+}
+
+func newTestSSHServer(t *testing.T) *testSSHServer {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		if string(password) != "secret" {
+			return nil, errors.New("wrong password")
+		}
+		return nil, nil
+	}}
+	config.AddHostKey(signer)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testSSHServer{listener: listener, config: config}
+	go s.serve()
+	return s
+}
+
+func (s *testSSHServer) serve() {
+	for {
+		netConn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			conn, chans, reqs, err := ssh.NewServerConn(netConn, s.config)
+			if err != nil {
+				return
+			}
+			s.lock.Lock()
+			s.conns = append(s.conns, conn)
+			s.lock.Unlock()
+			go s.requests(reqs)
+			for c := range chans {
+				if c.ChannelType() != "direct-tcpip" {
+					_ = c.Reject(ssh.Prohibited, "test server")
+					continue
+				}
+				go s.forward(c)
+			}
+		}()
+	}
+}
+
+// requests refuses the global requests of a client, or leaves them unanswered once muted
+func (s *testSSHServer) requests(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		s.lock.Lock()
+		muted := s.muted
+		s.lock.Unlock()
+		if req.WantReply && !muted {
+			_ = req.Reply(false, nil)
+		}
+	}
+}
+
+func (s *testSSHServer) mute() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.muted = true
+}
+
+// forward connects a direct-tcpip channel to its target
+func (s *testSSHServer) forward(c ssh.NewChannel) {
+	var target struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(c.ExtraData(), &target); err != nil {
+		_ = c.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	addr := net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port)))
+	s.lock.Lock()
+	s.dialed = append(s.dialed, addr)
+	s.lock.Unlock()
+	netConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		_ = c.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, reqs, err := c.Accept()
+	if err != nil {
+		_ = netConn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		_, _ = io.Copy(netConn, channel)
+		_ = netConn.Close()
+	}()
+	_, _ = io.Copy(channel, netConn)
+	_ = channel.Close()
+}
+
+// dials returns how many connections were opened, and the last one
+func (s *testSSHServer) dials() (int, *ssh.ServerConn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.conns) == 0 {
+		return 0, nil
+	}
+	return len(s.conns), s.conns[len(s.conns)-1]
+}
+
+// targets returns the addresses the server was asked to forward to
+func (s *testSSHServer) targets() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.dialed...)
+}
+
+func (s *testSSHServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *testSSHServer) host() Host {
+	addr := s.listener.Addr().(*net.TCPAddr)
+	return Host{Ip: addr.IP.String(), Port: addr.Port, Username: "deploy", Password: "secret"}
+}
+
+// withLoopbackPolicy lets sshConnect dial the test servers, the default policy refuses loopback.
+// Keepalives are off unless a test turns them on.
+func withLoopbackPolicy() func() {
+	oldPolicy, oldKnownHosts, oldInterval := targetPolicy, knownHosts, KeepaliveInterval
+	targetPolicy, knownHosts, KeepaliveInterval = mustCompilePolicy(&TargetPolicy{}), nil, 0
+	return func() { targetPolicy, knownHosts, KeepaliveInterval = oldPolicy, oldKnownHosts, oldInterval }
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// closed reports whether the client of a server connection went away
+func closed(conn *ssh.ServerConn) bool {
+	_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+	return err != nil
+}
+
+func TestSSHConnectJumps(t *testing.T) {
+	defer withLoopbackPolicy()()
+	first, second, target := newTestSSHServer(t), newTestSSHServer(t), newTestSSHServer(t)
+	for _, s := range []*testSSHServer{first, second, target} {
+		defer s.listener.Close()
+	}
+	host := target.host()
+	host.Jumps = []Host{first.host(), second.host()}
+
+	conn, err := sshConnect(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.hops) != 2 {
+		t.Fatalf("got %d hops, want 2", len(conn.hops))
+	}
+	// each hop is dialed through the one before it
+	if n, _ := first.dials(); n != 1 || len(first.targets()) != 1 || first.targets()[0] != second.addr() {
+		t.Errorf("the first jump host got %d connections and forwarded to %v, want %s", n, first.targets(), second.addr())
+	}
+	if got := second.targets(); len(got) != 1 || got[0] != target.addr() {
+		t.Errorf("the second jump host forwarded to %v, want %s", got, target.addr())
+	}
+	waitFor(t, "the target to see the connection", func() bool { n, _ := target.dials(); return n == 1 })
+
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range map[string]*testSSHServer{"first jump host": first, "second jump host": second, "target": target} {
+		_, serverConn := s.dials()
+		waitFor(t, "the "+name+" to be closed", func() bool { return closed(serverConn) })
+	}
+}
+
+func TestSSHConnectJumpFailure(t *testing.T) {
+	defer withLoopbackPolicy()()
+	jump, target := newTestSSHServer(t), newTestSSHServer(t)
+	defer jump.listener.Close()
+	defer target.listener.Close()
+
+	// the target refuses the login, the jump host that was already up must be closed
+	host := target.host()
+	host.Password = "wrong"
+	host.Jumps = []Host{jump.host()}
+	if _, err := sshConnect(host); err == nil {
+		t.Fatal("connected with a wrong password")
+	}
+	_, serverConn := jump.dials()
+	if serverConn == nil {
+		t.Fatal("the jump host wasn't dialed")
+	}
+	waitFor(t, "the jump host to be closed", func() bool { return closed(serverConn) })
+
+	// a failing jump host stops the chain before the target
+	host = target.host()
+	badJump := jump.host()
+	badJump.Password = "wrong"
+	host.Jumps = []Host{badJump}
+	if _, err := sshConnect(host); err == nil {
+		t.Fatal("connected through a jump host that refused the login")
+	}
+	if got := jump.targets(); len(got) != 1 {
+		t.Errorf("the jump host forwarded to %v, want the first attempt only", got)
+	}
+}
+
+// withTestAgent serves an empty ssh-agent on SSH_AUTH_SOCK
+func withTestAgent(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("unix", filepath.Join(dir, "agent.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = agent.ServeAgent(keyring, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	old, set := os.LookupEnv("SSH_AUTH_SOCK")
+	_ = os.Setenv("SSH_AUTH_SOCK", listener.Addr().String())
+	return func() {
+		if set {
+			_ = os.Setenv("SSH_AUTH_SOCK", old)
+		} else {
+			_ = os.Unsetenv("SSH_AUTH_SOCK")
+		}
+		_ = listener.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestAllowAgent(t *testing.T) {
+	defer withTestAgent(t)()
+	defer func(old bool) { AgentForAll = old }(AgentForAll)
+	admin, alice := &Principal{Name: "root", Admin: true}, &Principal{Name: "alice"}
+	tests := []struct {
+		principal *Principal
+		forAll    bool
+		want      bool
+	}{
+		{admin, false, true},
+		{alice, false, false},
+		{alice, true, true},
+	}
+	for _, tt := range tests {
+		AgentForAll = tt.forAll
+		host := Host{Ip: "10.0.0.1", Username: "deploy", Jumps: []Host{{Ip: "10.0.0.2", Username: "jump"}}}
+		allowAgent(&host, tt.principal)
+		if host.useAgent != tt.want || host.Jumps[0].useAgent != tt.want {
+			t.Errorf("%s with -ssh-agent-for-all %v: got %v and %v for the jump host, want %v",
+				tt.principal.Name, tt.forAll, host.useAgent, host.Jumps[0].useAgent, tt.want)
+		}
+		_, agentConn, err := authMethods(host, &authAttempts{})
+		if agentConn != nil {
+			_ = agentConn.Close()
+		}
+		if tt.want != (agentConn != nil) || tt.want != (err == nil) {
+			t.Errorf("%s with -ssh-agent-for-all %v: got agent %v and %v", tt.principal.Name, tt.forAll, agentConn != nil, err)
+		}
+	}
+
+	AgentForAll = false
+	_ = os.Unsetenv("SSH_AUTH_SOCK")
+	host := Host{Ip: "10.0.0.1", Username: "deploy"}
+	if allowAgent(&host, admin); host.useAgent {
+		t.Error("the agent is used without SSH_AUTH_SOCK")
+	}
+}
+
+// a principal who may not use the agent still has to bring a password or key
+func TestExecNodeShellWithoutCredentials(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer withTestAgent(t)()
+	defer func(old bool) { AgentForAll = old }(AgentForAll)
+	AgentForAll = false
+	tests := []string{
+		`{"ip":"10.0.0.1","username":"deploy"}`,
+		`{"ip":"10.0.0.1","username":"deploy","password":"secret","jumps":[{"ip":"10.0.0.2","username":"jump"}]}`,
+	}
+	for _, body := range tests {
+		recorder := httptest.NewRecorder()
+		context, _ := gin.CreateTestContext(recorder)
+		context.Set(principalKey, &Principal{Name: "alice"})
+		context.Request = httptest.NewRequest("POST", "/v1/terminal", strings.NewReader(body))
+		HandleExecNodeShell(context)
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d %s, want %d", body, recorder.Code, recorder.Body.String(), http.StatusBadRequest)
+		}
+	}
+}
@@ -3,20 +3,28 @@ package internal
 import (
 	"crypto/rand"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"github.com/golang/glog"
 	"io"
 	"log"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 	"gopkg.in/igm/sockjs-go.v2/sockjs"
 )
 
 const EndOfTransmission = "\u0004"
 
+// size of the pty requested for every shell before the browser sends its own size
+const (
+	defaultPtyCols = 400
+	defaultPtyRows = 20
+)
+
 // TerminalSize represents the width and height of a terminal.
 type TerminalSize struct {
 	Width  uint16
@@ -37,165 +45,336 @@ type PtyHandler interface {
 	TerminalSizeQueue
 }
 
-// TerminalSession implements PtyHandler (using a SockJS connection)
+// TerminalSession implements PtyHandler (using SockJS or WebSocket connections)
+//
+// The SSH session outlives its connections: several connections can be attached at the
+// same time, each with its own role. When the last one is lost the session is detached, output
+// keeps going to the scrollback buffer, and a new bind with the same id re-attaches and replays
+// the scrollback.
 type TerminalSession struct {
-	id            string
-	bound         chan error
-	sockJSSession sockjs.Session
-	sizeChan      chan *TerminalSize
+	// unix nanoseconds and byte counters, accessed atomically so they are kept first for 64-bit alignment
+	boundAt      int64
+	lastActivity int64
+	bytesIn      int64 // stdin sent to the process
+	bytesOut     int64 // output of the process
+	transferring int32 // 1 while a file transfer is running, its stdin isn't recorded
+	id           string
+	bound        chan error
+	done         chan struct{}
+	input        chan []byte
+	pending      []byte // stdin left over from the last Read, only touched by Read
+	sizeChan     chan *TerminalSize
+	createdAt    time.Time
+	principal    string // who created the terminal
+	target       string // user@host:port of the shell
+	hostId       string // id of the inventory host, empty when the host was given by address
+	recorder     *Recorder
+
+	lock        sync.Mutex // guards the fields below
+	attachments map[string]*attachment
+	shares      map[string]AttachRole
+	detachedAt  time.Time
+	scrollback  *ringBuffer
+	process     *ssh.Session   // the remote shell once it is started
+	conn        *sshConnection // the connection of the shell once it is dialed
+	lastInput   string         // id of the connection that sent the last stdin
+	outputTail  []byte         // end of the last output, to find a transfer magic split between writes
+	transfer    *fileTransfer  // the file transfer in progress, nil most of the time
+
+	sftpLock sync.Mutex // guards sftp, opening it takes a round trip so t.lock isn't held
+	sftp     *sftp.Client
+}
+
+// ScrollbackSize is how many bytes of recent output are kept per session for replay on re-attach
+var ScrollbackSize = 64 * 1024
+
+// newTerminalSession creates an unbound terminal session waiting for its connection,
+// host is where the shell will be opened, recorder may be nil
+func newTerminalSession(id string, principal *Principal, host Host, recorder *Recorder) *TerminalSession {
+	now := time.Now()
+	return &TerminalSession{
+		id:           id,
+		bound:        make(chan error),
+		done:         make(chan struct{}),
+		input:        make(chan []byte),
+		sizeChan:     make(chan *TerminalSize),
+		createdAt:    now,
+		principal:    principal.Name,
+		target:       fmt.Sprintf("%s@%s:%d", host.Username, host.Ip, host.Port),
+		hostId:       host.HostId,
+		recorder:     recorder,
+		lastActivity: now.UnixNano(),
+		attachments:  make(map[string]*attachment),
+		shares:       make(map[string]AttachRole),
+		scrollback:   newRingBuffer(ScrollbackSize),
+	}
+}
+
+// touch records stdin/stdout activity for the idle timeout
+func (t *TerminalSession) touch() {
+	atomic.StoreInt64(&t.lastActivity, time.Now().UnixNano())
 }
 
 // TerminalMessage is the messaging protocol between ShellController and TerminalSession.
+// On SockJS every message is JSON, on the native WebSocket stdin and stdout are raw binary
+// frames and only the other ops are JSON text frames.
 //
 // OP      DIRECTION  FIELD(S) USED  DESCRIPTION
 // ---------------------------------------------------------------------
-// bind    fe->be     SessionID      Id sent back from TerminalResponse
+// bind    fe->be     SessionID      Id sent back from TerminalResponse (again to re-attach)
+// bind    fe->be     Token          Share token, when joining someone else's session
 // stdin   fe->be     Data           Keystrokes/paste buffer
 // resize  fe->be     Rows, Cols     New terminal size
 // stdout  be->fe     Data           Output from the process
 // toast   be->fe     Data           OOB message to be shown to the user
+// bind    fe->be     Encoding       "base64" for base64 stdin/stdout Data on SockJS, default "utf8"
+// replay  fe->be     RecordingID    Play a recording back instead of binding a session
+// replay  fe->be     Speed          Replay speed, 1, 2 or 4
+// resize  be->fe     Rows, Cols     Terminal size of the recording being replayed
+// signal  fe->be     Signal         Send INT, TERM, KILL, HUP or QUIT to the remote process
+// transfer_start be->fe Protocol   "zmodem" or "trzsz", the shell started sz/rz or tsz/trz
+// transfer_start be->fe Direction  "download" (sz, tsz) or "upload" (rz, trz)
+// transfer fe<->be   Data           Base64 of the raw protocol bytes while transferring
+// transfer_end fe<->be Data         End of the transfer, "cancel" from the browser aborts it, "timeout" from the server ends an idle one
+// exit    be->fe     Reason         Why the terminal is closed, see ExitReason
+// exit    be->fe     ExitCode       Exit status of the remote process
+// exit    be->fe     Signal         Signal that killed the remote process, e.g. "KILL"
+// exit    be->fe     Data           Message shown to the user, also the close reason
 type TerminalMessage struct {
-	Op, Data, SessionID string
-	Rows, Cols          uint16
+	Op, Data, SessionID, Token string
+	Rows, Cols                 uint16
+	RecordingID                string
+	Speed                      float64
+	Encoding                   string
+	Reason                     string
+	ExitCode                   int
+	Signal                     string
+	Protocol, Direction        string
 }
 
 // TerminalSize handles pty->process resize events
-// Called in a loop from remotecommand as long as the process is running
-func (t TerminalSession) Next() *TerminalSize {
+// Called in a loop from remotecommand as long as the process is running, nil once the terminal is closed
+func (t *TerminalSession) Next() (size *TerminalSize) {
+	defer t.recoverCallback(nil)
 	select {
-	case size := <-t.sizeChan:
+	case size = <-t.sizeChan:
+		if size != nil {
+			t.recorder.Resize(size)
+		}
 		return size
+	case <-t.done:
+		return nil
 	}
 }
 
-// Read handles pty->process messages (stdin, resize)
+// Read handles pty->process stdin, fed by the pumps of the attached connections
 // Called in a loop from remotecommand as long as the process is running
-func (t TerminalSession) Read(p []byte) (int, error) {
-	m, err := t.sockJSSession.Recv()
-	if err != nil {
-		// Send terminated signal to process to avoid resource leak
-		return copy(p, EndOfTransmission), err
-	}
-
-	var msg TerminalMessage
-	if err := json.Unmarshal([]byte(m), &msg); err != nil {
-		return copy(p, EndOfTransmission), err
+func (t *TerminalSession) Read(p []byte) (n int, err error) {
+	defer t.recoverCallback(&err)
+	if len(t.pending) == 0 {
+		select {
+		case t.pending = <-t.input:
+		case <-t.done:
+			// Send terminated signal to process to avoid resource leak
+			return copy(p, EndOfTransmission), io.EOF
+		}
 	}
-
-	switch msg.Op {
-	case "stdin":
-		return copy(p, msg.Data), nil
-	case "resize":
-		t.sizeChan <- &TerminalSize{Width: msg.Cols, Height: msg.Rows}
-		return 0, nil
-	default:
-		return copy(p, EndOfTransmission), fmt.Errorf("unknown message type '%s'", msg.Op)
+	n = copy(p, t.pending)
+	t.pending = t.pending[n:]
+	atomic.AddInt64(&t.bytesIn, int64(n))
+	stdinBytes.Add(float64(n))
+	if atomic.LoadInt32(&t.transferring) == 0 {
+		t.recorder.Input(p[:n])
 	}
+	return n, nil
 }
 
 // Write handles process->pty stdout
-// Called from remotecommand whenever there is any output
-func (t TerminalSession) Write(p []byte) (int, error) {
-	msg, err := json.Marshal(TerminalMessage{
-		Op:   "stdout",
-		Data: string(p),
-	})
-	if err != nil {
-		return 0, err
+// Called from remotecommand whenever there is any output, it never fails because of the
+// transport so the process keeps running while the browser is reconnecting
+// During a ZMODEM or trzsz transfer the output goes to one connection as transfer messages and
+// is neither recorded nor kept in the scrollback
+func (t *TerminalSession) Write(p []byte) (n int, err error) {
+	defer t.recoverCallback(&err)
+	t.touch()
+	atomic.AddInt64(&t.bytesOut, int64(len(p)))
+	stdoutBytes.Add(float64(len(p)))
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for data := p; len(data) > 0; {
+		if t.transfer == nil {
+			data = t.detectTransferLocked(data)
+			continue
+		}
+		var transfer []byte
+		var ended bool
+		transfer, data, ended = t.transfer.split(data)
+		t.sendTransferLocked(transfer)
+		if ended {
+			t.endTransferLocked(false, "")
+		}
 	}
+	return len(p), nil
+}
 
-	if err = t.sockJSSession.Send(string(msg)); err != nil {
-		return 0, err
+func (t *TerminalSession) writeStdoutLocked(p []byte) {
+	if len(p) == 0 {
+		return
 	}
-	return len(p), nil
+	t.recorder.Output(p)
+	t.scrollback.Write(p)
+	t.broadcastLocked(func(conn terminalConn) error {
+		return conn.SendStdout(p)
+	})
 }
 
 // Toast can be used to send the user any OOB messages
 // hterm puts these in the center of the terminal
-func (t TerminalSession) Toast(p string) error {
-	msg, err := json.Marshal(TerminalMessage{
-		Op:   "toast",
-		Data: p,
+func (t *TerminalSession) Toast(p string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.broadcastLocked(func(conn terminalConn) error {
+		return conn.SendMessage(TerminalMessage{Op: "toast", Data: p})
 	})
-	if err != nil {
-		return err
-	}
-
-	if err = t.sockJSSession.Send(string(msg)); err != nil {
-		return err
-	}
 	return nil
 }
 
 // SessionMap stores a map of all TerminalSession objects and a lock to avoid concurrent conflict
 type SessionMap struct {
-	Sessions map[string]TerminalSession
+	Sessions map[string]*TerminalSession
 	Lock     sync.RWMutex
 }
 
-// Get return a given terminalSession by sessionId
-func (sm *SessionMap) Get(sessionId string) TerminalSession {
+// Get return a given terminalSession by sessionId, nil if there is no such session
+func (sm *SessionMap) Get(sessionId string) *TerminalSession {
 	sm.Lock.RLock()
 	defer sm.Lock.RUnlock()
 	return sm.Sessions[sessionId]
 }
 
 // Set store a TerminalSession to SessionMap
-func (sm *SessionMap) Set(sessionId string, session TerminalSession) {
+func (sm *SessionMap) Set(sessionId string, session *TerminalSession) {
 	sm.Lock.Lock()
 	defer sm.Lock.Unlock()
 	sm.Sessions[sessionId] = session
 }
 
-// Close shuts down the SockJS connection and sends the status code and reason to the client
+// Bind attaches a SockJS or WebSocket connection to a session, first reports whether this is the first bind
+// of the session (the process still has to be started) or a re-attach. Without a share token
+// the connection is attached as the owner, which only the principal who created it may do.
+func (sm *SessionMap) Bind(sessionId, token string, principal *Principal, conn terminalConn) (terminalSession *TerminalSession, first bool, err error) {
+	if terminalSession = sm.Get(sessionId); terminalSession == nil {
+		return nil, false, fmt.Errorf("can't find session '%s'", sessionId)
+	}
+	role := RoleOwner
+	if token == "" && !principal.allowed(terminalSession.principal) {
+		return nil, false, fmt.Errorf("session '%s' belongs to another principal, %s can't bind it", sessionId, principal.Name)
+	}
+	if token != "" {
+		if role, err = terminalSession.shareRole(token); err != nil {
+			return nil, false, err
+		}
+	}
+	if err = terminalSession.attach(conn, role); err != nil {
+		return nil, false, err
+	}
+	first = atomic.CompareAndSwapInt64(&terminalSession.boundAt, 0, time.Now().UnixNano())
+	terminalSession.touch()
+	return terminalSession, first, nil
+}
+
+// Close sends the exit message to the connections, then shuts them down with the status code
+// and message of exit as close reason
 // Can happen if the process exits or if there is an error starting up the process
-// For now the status code is unused and reason is shown to the user (unless "")
-func (sm *SessionMap) Close(sessionId string, status uint32, reason string) {
+// Closing a session that is already gone does nothing
+func (sm *SessionMap) Close(sessionId string, exit TerminalExit) {
 	sm.Lock.Lock()
-	defer sm.Lock.Unlock()
-	_ = sm.Sessions[sessionId].sockJSSession.Close(status, reason)
+	terminalSession, ok := sm.Sessions[sessionId]
+	if !ok {
+		sm.Lock.Unlock()
+		return
+	}
 	delete(sm.Sessions, sessionId)
+	sm.Lock.Unlock()
+
+	// Write holds the session lock while a slow connection blocks a broadcast, so it is only
+	// taken once the map is unlocked, otherwise one client could stall every other session
+	terminalSession.lock.Lock()
+	attachments := terminalSession.attachments
+	terminalSession.attachments = make(map[string]*attachment)
+	close(terminalSession.done)
+	terminalSession.lock.Unlock()
+
+	if exit.Reason != ExitProcessExited {
+		sessionFailures.WithLabelValues(string(exit.Reason)).Inc()
+	}
+	portForwards.closeSession(sessionId)
+	for _, a := range attachments {
+		_ = a.conn.SendMessage(exit.message())
+		_ = a.conn.Close(exit.Status, exit.Message)
+	}
+	if err := terminalSession.recorder.Finish(exit); err != nil {
+		glog.Errorf("recorder %s: %v", terminalSession.recorder.ID(), err)
+	}
 }
 
-var terminalSessions = SessionMap{Sessions: make(map[string]TerminalSession)}
+var terminalSessions = SessionMap{Sessions: make(map[string]*TerminalSession)}
 
-// handleTerminalSession is Called by net/http for any new /api/sockjs connections
-func handleTerminalSession(session sockjs.Session) {
+// handleTerminalSession is Called for any new /v1/sockjs or /v1/ws connections
+func handleTerminalSession(conn terminalConn, principal *Principal) {
+	defer recoverSession("")
 	var (
-		buf             string
 		err             error
 		msg             TerminalMessage
-		terminalSession TerminalSession
+		terminalSession *TerminalSession
+		first           bool
 	)
 
-	if buf, err = session.Recv(); err != nil {
+	if msg, err = conn.Recv(); err != nil {
 		log.Printf("handleTerminalSession: can't Recv: %v", err)
 		return
 	}
 
-	if err = json.Unmarshal([]byte(buf), &msg); err != nil {
-		log.Printf("handleTerminalSession: can't UnMarshal (%v): %s", err, buf)
+	if err = conn.setEncoding(msg.Encoding); err != nil {
+		log.Printf("handleTerminalSession: %v", err)
+		_ = conn.Close(closeError, err.Error())
 		return
 	}
 
-	if msg.Op != "bind" {
-		log.Printf("handleTerminalSession: expected 'bind' message, got: %s", buf)
+	if msg.Op == "replay" {
+		replayRecording(conn, principal, msg.RecordingID, msg.Speed)
 		return
 	}
 
-	if terminalSession = terminalSessions.Get(msg.SessionID); terminalSession.id == "" {
-		log.Printf("handleTerminalSession: can't find session '%s'", msg.SessionID)
+	if msg.Op != "bind" {
+		log.Printf("handleTerminalSession: expected 'bind' message, got: %s", msg.Op)
+		_ = conn.Close(closeError, "expected a bind message")
 		return
 	}
 
-	terminalSession.sockJSSession = session
-	terminalSessions.Set(msg.SessionID, terminalSession)
-	terminalSession.bound <- nil
+	if terminalSession, first, err = terminalSessions.Bind(msg.SessionID, msg.Token, principal, conn); err != nil {
+		log.Printf("handleTerminalSession: %v", err)
+		_ = conn.Close(closeError, err.Error())
+		return
+	}
+	if !first { //断线重连，进程已经在运行了
+		return
+	}
+	select {
+	case terminalSession.bound <- nil:
+	case <-terminalSession.done:
+	}
 }
 
-// CreateAttachHandler is called from main for /api/sockjs
-func CreateAttachHandler(path string) http.Handler {
-	return sockjs.NewHandler(path, sockjs.DefaultOptions, handleTerminalSession)
+// CreateAttachHandler is called from main for /api/sockjs, principal is who opened the connection
+// and clientIP where from
+func CreateAttachHandler(path string, principal *Principal, clientIP string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		transport := sockJSTransport(r.URL.Path)
+		sockjs.NewHandler(path, sockjs.DefaultOptions, func(session sockjs.Session) {
+			handleTerminalSession(newSockJSConn(session, clientIP, transport), principal)
+		}).ServeHTTP(w, r)
+	})
 }
 
 // genTerminalSessionId generates a random session ID string. The format is not really interesting.
@@ -219,33 +398,62 @@ func genTerminalSessionId() (string, error) {
  * @author: inori
  * @time  : 2019/3/21 14:56
  */
-func WaitForNodeTerminal(ip, username string, port int, password, sessionId string) {
+func WaitForNodeTerminal(host Host, sessionId string) {
+	defer recoverSession(sessionId)
+	terminalSession := terminalSessions.Get(sessionId)
 	select {
-	case <-terminalSessions.Get(sessionId).bound:
-		close(terminalSessions.Get(sessionId).bound)
+	case <-terminalSession.done: //超时未连接，已经被回收
+		return
+	case <-terminalSession.bound:
+		close(terminalSession.bound)
 
-		err := startNodeProcess(username, ip, port, password, terminalSessions.Get(sessionId))
-		terminalSessions.Get(sessionId).sizeChan <- nil //在关闭终端之前发一条空数据，resize协程接收到nil会退出
+		conn, release, err := sshConnections.Acquire(host)
 		if err != nil {
-			terminalSessions.Close(sessionId, 2, err.Error())
+			glog.Error(err)
+			if _, ok := err.(*HostKeyChangedError); ok {
+				_ = terminalSession.Toast(err.Error())
+			}
+			terminalSessions.Close(sessionId, errorExit(err))
 			return
 		}
-		terminalSessions.Close(sessionId, 1, "Process exited")
+		defer release() //连到同一台主机的最后一个终端退出后才关闭整条跳板机链路
+		terminalSession.setConnection(conn)
+		defer terminalSession.closeSFTP()
+
+		// 终端被回收或者被关闭时关闭shell，Wait会返回，不会一直挂着。连接可能还有其他终端在用，不能断开
+		exited := make(chan struct{})
+		defer close(exited)
+		go func() {
+			defer recoverSession("")
+			select {
+			case <-terminalSession.done:
+				terminalSession.closeProcess()
+			case <-exited:
+			}
+		}()
+
+		//关闭终端后resize协程的Next返回nil，协程退出
+		exit := startNodeProcess(conn, terminalSession)
+		if err := conn.lostError(); err != nil { //主机没有响应keepalive，连接被断开
+			exit = errorExit(err)
+			_ = terminalSession.Toast(exit.Message)
+		}
+		terminalSessions.Close(sessionId, exit)
 	}
 }
 
 /**
  * 开始node shell连接进程
  * @param :
- * @return:
+ * @return: shell的退出状态
  * @author: inori
  * @time  : 2019/3/21 14:57
  */
-func startNodeProcess(username, ip string, port int, password string, ptyHandler PtyHandler) error {
-	session, err := sshConnect(username, password, ip, port)
+func startNodeProcess(conn *sshConnection, ptyHandler PtyHandler) TerminalExit {
+	session, err := conn.NewSession()
 	if err != nil {
 		glog.Error(err)
-		return err
+		return errorExit(err)
 	}
 	defer session.Close()
 
@@ -257,17 +465,21 @@ func startNodeProcess(username, ip string, port int, password string, ptyHandler
 	}
 	// Request pseudo terminal
 	//其实高没什么影响，宽设置的大一点，不然超过限制的字符会自动跳到行首
-	if err := session.RequestPty("xterm", 20, 400, modes); err != nil {
-		return err
+	if err := session.RequestPty("xterm", defaultPtyRows, defaultPtyCols, modes); err != nil {
+		return errorExit(err)
 	}
 	session.Stdout = ptyHandler
 	session.Stderr = ptyHandler
 	session.Stdin = ptyHandler
 	if err := session.Shell(); nil != err {
-		panic(err)
-		return err
+		glog.Error(err)
+		return errorExit(err)
+	}
+	if handler, ok := ptyHandler.(processHandler); ok {
+		handler.setProcess(session)
 	}
 	go func() { //监听终端大小变化
+		defer recoverSession("")
 		for {
 			next := ptyHandler.Next()
 			if next == nil { //当接收到nil时，退出协程
@@ -276,9 +488,5 @@ func startNodeProcess(username, ip string, port int, password string, ptyHandler
 			_ = session.WindowChange(int(next.Height), int(next.Width))
 		}
 	}()
-	if err := session.Wait(); nil != err {
-		panic(err)
-		return err
-	}
-	return nil
+	return processExit(session.Wait())
 }
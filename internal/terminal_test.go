@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// testSockJSSession is a SockJS connection whose incoming messages are fed by the test,
+// closing recv loses the connection
+type testSockJSSession struct {
+	id   string
+	recv chan string
+
+	lock   sync.Mutex
+	sent   []TerminalMessage
+	closed bool
+	status uint32
+	reason string
+}
+
+func newTestSockJSSession(id string) *testSockJSSession {
+	return &testSockJSSession{id: id, recv: make(chan string)}
+}
+
+func (s *testSockJSSession) ID() string { return s.id }
+
+func (s *testSockJSSession) Recv() (string, error) {
+	m, ok := <-s.recv
+	if !ok {
+		return "", errors.New("connection lost")
+	}
+	return m, nil
+}
+
+func (s *testSockJSSession) Send(m string) error {
+	var msg TerminalMessage
+	if err := json.Unmarshal([]byte(m), &msg); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sent = append(s.sent, msg)
+	return nil
+}
+
+func (s *testSockJSSession) Close(status uint32, reason string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed, s.status, s.reason = true, status, reason
+	return nil
+}
+
+// stdout returns the output sent to the connection
+func (s *testSockJSSession) stdout() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var out string
+	for _, msg := range s.sent {
+		if msg.Op == "stdout" {
+			out += msg.Data
+		}
+	}
+	return out
+}
+
+func TestScrollbackReplay(t *testing.T) {
+	defer func(old int) { ScrollbackSize = old }(ScrollbackSize)
+	ScrollbackSize = 8
+	sm := &SessionMap{Sessions: make(map[string]*TerminalSession)}
+	alice := &Principal{Name: "alice"}
+	terminalSession := newTerminalSession("scrollback-test", alice, Host{}, nil)
+	sm.Set(terminalSession.id, terminalSession)
+	defer sm.Close(terminalSession.id, TerminalExit{Reason: ExitProcessExited})
+
+	first := newTestSockJSSession("first")
+	if _, isFirst, err := sm.Bind(terminalSession.id, "", alice, newSockJSConn(first, "127.0.0.1", TransportSockJS)); err != nil || !isFirst {
+		t.Fatalf("first bind: %v, first %v", err, isFirst)
+	}
+	if _, err := terminalSession.Write([]byte("$ ")); err != nil {
+		t.Fatal(err)
+	}
+	if got := first.stdout(); got != "$ " {
+		t.Fatalf("got %q before the connection was lost", got)
+	}
+
+	close(first.recv)
+	waitFor(t, "the terminal to detach", func() bool { return !terminalSession.detachedSince().IsZero() })
+	// the process keeps writing while nobody is attached, the oldest output and the cut
+	// character fall out of the scrollback
+	if _, err := terminalSession.Write([]byte("世界abc")); err != nil {
+		t.Fatal(err)
+	}
+
+	second := newTestSockJSSession("second")
+	defer close(second.recv)
+	if _, isFirst, err := sm.Bind(terminalSession.id, "", alice, newSockJSConn(second, "127.0.0.1", TransportSockJS)); err != nil || isFirst {
+		t.Fatalf("re-attach: %v, first %v", err, isFirst)
+	}
+	if got := second.stdout(); got != "界abc" {
+		t.Errorf("replayed %q, want the scrollback without the cut character", got)
+	}
+	if !terminalSession.detachedSince().IsZero() {
+		t.Error("the terminal is still detached after the re-attach")
+	}
+	if got := first.stdout(); got != "$ " {
+		t.Errorf("the lost connection got %q", got)
+	}
+}
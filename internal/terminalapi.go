@@ -6,19 +6,30 @@
 package internal
 
 import (
+    "fmt"
     "github.com/gin-gonic/gin"
     "net/http"
 )
 
 type TerminalResponse struct {
-    Id string `json:"id"`
+    Id          string `json:"id"`
+    RecordingId string `json:"recordingId,omitempty"` // 开启录像时返回
 }
 
 type Host struct {
-    Ip       string `json:"ip"`
-    Username string `json:"username"`
-    Password string `json:"password"`
-    Port     int    `json:"port"`
+    Ip         string `json:"ip"`
+    Username   string `json:"username"`
+    Password   string `json:"password"`
+    Port       int    `json:"port"`
+    PrivateKey string `json:"privateKey"` // PEM格式的私钥
+    Passphrase string `json:"passphrase"` // 私钥密码，私钥未加密时为空
+    Jumps      []Host `json:"jumps"`      // 跳板机，按顺序连接，每一跳使用自己的认证信息
+
+    CredentialId string `json:"credentialId"` // 使用凭据库中保存的用户名、密码和私钥
+    HostId       string `json:"hostId"`       // 主机清单中的主机id或名称，地址、端口、用户和跳板机从清单中读取
+
+    identityFile string // 主机清单中配置的服务器本地私钥，只有管理员可以使用
+    useAgent     bool   // 使用服务端的ssh-agent，只有管理员或开启-ssh-agent-for-all时可以使用
 }
 
 /**
@@ -30,25 +41,129 @@ type Host struct {
  */
 func HandleExecNodeShell(context *gin.Context) {
     var host Host
-    err := context.BindJSON(&host)
-    if err != nil || host.Ip == "" || host.Username == "" || host.Password == "" {
+    if err := context.BindJSON(&host); err != nil {
+        context.JSON(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+        return
+    }
+    principal := CurrentPrincipal(context)
+    if err := resolveInventoryHost(&host, principal); err != nil {
+        Fail(err.Error(), context)
+        return
+    }
+    if err := resolveCredentials(&host, principal); err != nil {
+        Fail(err.Error(), context)
+        return
+    }
+    if host.Ip == "" || host.Username == "" {
+        context.JSON(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+        return
+    }
+    allowAgent(&host, principal)
+    if host.Password == "" && host.PrivateKey == "" && !host.useAgent {
         context.JSON(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
         return
     }
     if host.Port == 0 {
         host.Port = 22
     }
+    for _, jump := range host.Jumps {
+        if jump.Ip == "" || jump.Username == "" || (jump.Password == "" && jump.PrivateKey == "" && !jump.useAgent) {
+            context.JSON(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+            return
+        }
+    }
+    if err := checkTarget(host); err != nil {
+        if _, ok := err.(*TargetBlockedError); ok {
+            FailWithCode(TARGET_BLOCKED, err.Error(), context)
+            return
+        }
+        Fail(err.Error(), context)
+        return
+    }
     sessionId, err := genTerminalSessionId()
     if err != nil {
         Fail(err.Error(), context)
         return
     }
-    terminalSessions.Set(sessionId, TerminalSession{
-        id:       sessionId,
-        bound:    make(chan error),
-        sizeChan: make(chan *TerminalSize),
-    })
+    recorder, err := newRecorder(principal, host.Username, fmt.Sprintf("%s:%d", host.Ip, host.Port))
+    if err != nil {
+        Fail(err.Error(), context)
+        return
+    }
+    terminalSessions.Set(sessionId, newTerminalSession(sessionId, principal, host, recorder))
+
+    go WaitForNodeTerminal(host, sessionId)
+    SuccessWithData(TerminalResponse{Id: sessionId, RecordingId: recorder.ID()}, context)
+}
 
-    go WaitForNodeTerminal(host.Ip, host.Username, host.Port, host.Password, sessionId)
-    SuccessWithData(TerminalResponse{Id: sessionId}, context)
+type ShareRequest struct {
+    Role string `json:"role"`
+}
+
+type ShareResponse struct {
+    Id    string     `json:"id"`
+    Token string     `json:"token"`
+    Role  AttachRole `json:"role"`
+}
+
+// HandleShareTerminal returns a token others bind the terminal with, as a writer or readonly (the default)
+func HandleShareTerminal(context *gin.Context) {
+    var req ShareRequest
+    if context.Request.ContentLength > 0 {
+        if err := context.BindJSON(&req); err != nil {
+            return
+        }
+    }
+    role, err := ParseShareRole(req.Role)
+    if err != nil {
+        context.JSON(http.StatusBadRequest, err.Error())
+        return
+    }
+    sessionId := context.Param("id")
+    terminalSession := terminalSessions.Get(sessionId)
+    if terminalSession == nil {
+        Fail(fmt.Sprintf("can't find session '%s'", sessionId), context)
+        return
+    }
+    if !CurrentPrincipal(context).allowed(terminalSession.principal) {
+        context.JSON(http.StatusForbidden, http.StatusText(http.StatusForbidden))
+        return
+    }
+    token, err := terminalSession.share(role)
+    if err != nil {
+        Fail(err.Error(), context)
+        return
+    }
+    SuccessWithData(ShareResponse{
+        Id:    sessionId,
+        Token: token,
+        Role:  role,
+    }, context)
+}
+
+type SignalRequest struct {
+    Signal string `json:"signal"`
+}
+
+// HandleSignalTerminal lets an administrator send INT, TERM, KILL, HUP or QUIT to the remote process
+func HandleSignalTerminal(context *gin.Context) {
+    var req SignalRequest
+    if err := context.BindJSON(&req); err != nil {
+        return
+    }
+    if _, err := ParseSignal(req.Signal); err != nil {
+        context.JSON(http.StatusBadRequest, err.Error())
+        return
+    }
+    sessionId := context.Param("id")
+    terminalSession := terminalSessions.Get(sessionId)
+    if terminalSession == nil {
+        Fail(fmt.Sprintf("can't find session '%s'", sessionId), context)
+        return
+    }
+    if err := terminalSession.Signal(req.Signal); err != nil {
+        Fail(err.Error(), context)
+        return
+    }
+    Success(context)
 }
@@ -0,0 +1,240 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// File transfer protocols detected in the output of the shell
+const (
+	TransferZmodem = "zmodem"
+	TransferTrzsz  = "trzsz"
+)
+
+// Directions of a file transfer, seen from the browser
+const (
+	TransferDownload = "download" // sz, tsz: the remote process sends
+	TransferUpload   = "upload"   // rz, trz: the remote process receives
+)
+
+// transferMagic starts a transfer when the shell prints it. The browser drives the protocol
+// (zmodem.js or trzsz.js), the server only routes the raw bytes to and from one connection.
+type transferMagic struct {
+	magic     []byte
+	protocol  string
+	direction string
+}
+
+var transferMagics = []transferMagic{
+	{[]byte("**\x18B00"), TransferZmodem, TransferDownload}, // ZRQINIT hex header of sz
+	{[]byte("**\x18B01"), TransferZmodem, TransferUpload},   // ZRINIT hex header of rz
+	{[]byte("::TRZSZ:TRANSFER:S:"), TransferTrzsz, TransferDownload},
+	{[]byte("::TRZSZ:TRANSFER:R:"), TransferTrzsz, TransferUpload},
+	{[]byte("::TRZSZ:TRANSFER:D:"), TransferTrzsz, TransferUpload}, // trz -d, a directory
+}
+
+// transferTailSize is how much output is kept to find a magic split between two writes
+const transferTailSize = 24
+
+var (
+	// zmodemFin is the hex header of ZFIN, the last frame of a ZMODEM session
+	zmodemFin = []byte("**\x18B08")
+	// zmodemCancel aborts a ZMODEM session, 8 CAN followed by as many backspaces
+	zmodemCancel = []byte("\x18\x18\x18\x18\x18\x18\x18\x18\x08\x08\x08\x08\x08\x08\x08\x08")
+	// zmodemAborted is what the remote side prints when the session is cancelled
+	zmodemAborted = []byte("\x18\x18\x18\x18\x18")
+)
+
+// zmodemHeaderSize is the size of a hex header: ZPAD ZPAD ZDLE 'B', 14 hex digits, CR LF
+const zmodemHeaderSize = 20
+
+// transferIdleTimeout ends a transfer that moved no data either way for this long. trzsz has no end
+// marker in the output, a browser that never sends transfer_end would keep the terminal in
+// transfer mode and hide the shell from every connection.
+const transferIdleTimeout = time.Minute
+
+// fileTransfer is a transfer in progress, output goes to a single connection as transfer messages
+// instead of stdout until it ends
+type fileTransfer struct {
+	protocol  string
+	direction string
+	conn      string    // id of the connection the transfer belongs to
+	finishing bool      // the process sent ZFIN of a download, "OO" ends it
+	lastData  time.Time // last transfer data from the process or the browser
+}
+
+// split cuts the output of the process at the end of the transfer, ended is set when p contains it
+func (f *fileTransfer) split(p []byte) (data, rest []byte, ended bool) {
+	if f.protocol != TransferZmodem {
+		// trzsz has no end marker in the output, the browser sends transfer_end
+		return p, nil, false
+	}
+	if i := bytes.Index(p, zmodemAborted); i >= 0 {
+		end := i + len(zmodemAborted)
+		for end < len(p) && (p[end] == 0x18 || p[end] == 0x08) {
+			end++
+		}
+		return p[:end], p[end:], true
+	}
+	if f.finishing {
+		if i := bytes.Index(p, []byte("OO")); i >= 0 {
+			return p[:i+2], p[i+2:], true
+		}
+		return p, nil, false
+	}
+	if i := bytes.Index(p, zmodemFin); i >= 0 {
+		if f.direction == TransferDownload {
+			// the browser answers ZFIN, then sz prints "OO"
+			f.finishing = true
+			data, rest, ended = f.split(p[i+len(zmodemFin):])
+			return p[:i+len(zmodemFin)+len(data)], rest, ended
+		}
+		// rz answers the ZFIN of the browser with its own and exits, the browser sends "OO"
+		end := i + zmodemHeaderSize
+		if end > len(p) {
+			end = len(p)
+		}
+		return p[:end], p[end:], true
+	}
+	return p, nil, false
+}
+
+// transferConnLocked picks the connection a transfer goes to: the one that typed last, or else
+// any connection allowed to write. Empty when there is none.
+func (t *TerminalSession) transferConnLocked() string {
+	if a, ok := t.attachments[t.lastInput]; ok && a.canWrite() {
+		return t.lastInput
+	}
+	for id, a := range t.attachments {
+		if a.canWrite() {
+			return id
+		}
+	}
+	return ""
+}
+
+// detectTransferLocked sends p as stdout up to the start of a transfer, if there is one. It
+// returns the start of the transfer data once a transfer has been started.
+func (t *TerminalSession) detectTransferLocked(p []byte) []byte {
+	window := append(append([]byte{}, t.outputTail...), p...)
+	start, found := -1, transferMagic{}
+	for _, m := range transferMagics {
+		if i := bytes.Index(window, m.magic); i >= 0 && (start < 0 || i < start) {
+			start, found = i, m
+		}
+	}
+	if start < 0 {
+		t.keepTailLocked(p)
+		t.writeStdoutLocked(p)
+		return nil
+	}
+
+	conn := t.transferConnLocked()
+	if conn == "" {
+		// nobody can answer, don't leave rz or sz waiting for a browser
+		if found.protocol == TransferZmodem {
+			go t.sendInput(zmodemCancel)
+		}
+		t.outputTail = nil
+		t.writeStdoutLocked(p)
+		return nil
+	}
+
+	// a magic that started in the previous write was shown as stdout already, the browser still
+	// needs all of it
+	data := window[start:]
+	if tail := len(window) - len(p); start > tail {
+		t.writeStdoutLocked(p[:start-tail])
+	}
+	t.transfer = &fileTransfer{protocol: found.protocol, direction: found.direction, conn: conn, lastData: time.Now()}
+	atomic.StoreInt32(&t.transferring, 1)
+	t.outputTail = nil
+	if a, ok := t.attachments[conn]; ok {
+		_ = a.conn.SendMessage(TerminalMessage{Op: "transfer_start", Protocol: found.protocol, Direction: found.direction})
+	}
+	return data
+}
+
+func (t *TerminalSession) keepTailLocked(p []byte) {
+	t.outputTail = append(t.outputTail, p...)
+	if len(t.outputTail) > transferTailSize {
+		t.outputTail = append([]byte{}, t.outputTail[len(t.outputTail)-transferTailSize:]...)
+	}
+}
+
+// sendTransferLocked sends output of the process to the connection of the transfer
+func (t *TerminalSession) sendTransferLocked(data []byte) {
+	a, ok := t.attachments[t.transfer.conn]
+	if !ok || len(data) == 0 {
+		return
+	}
+	t.transfer.lastData = time.Now()
+	msg := TerminalMessage{Op: "transfer", Data: base64.StdEncoding.EncodeToString(data)}
+	if err := a.conn.SendMessage(msg); err != nil {
+		t.detachLocked(a)
+	}
+}
+
+// endTransferLocked leaves transfer mode, cancel aborts a ZMODEM session still running on the
+// remote side. reason is sent to the connection of the transfer, if it is still there.
+func (t *TerminalSession) endTransferLocked(cancel bool, reason string) {
+	if t.transfer == nil {
+		return
+	}
+	if cancel && t.transfer.protocol == TransferZmodem {
+		go t.sendInput(zmodemCancel)
+	}
+	if a, ok := t.attachments[t.transfer.conn]; ok {
+		_ = a.conn.SendMessage(TerminalMessage{Op: "transfer_end", Data: reason})
+	}
+	t.transfer = nil
+	atomic.StoreInt32(&t.transferring, 0)
+}
+
+// endIdleTransfer leaves a transfer that moved no data since transferIdleTimeout before now, a
+// ZMODEM session is aborted like on a lost connection
+func (t *TerminalSession) endIdleTransfer(now time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.transfer != nil && now.Sub(t.transfer.lastData) > transferIdleTimeout {
+		t.endTransferLocked(true, "timeout")
+	}
+}
+
+// sendInput queues bytes for the stdin of the process
+func (t *TerminalSession) sendInput(p []byte) {
+	select {
+	case t.input <- p:
+	case <-t.done:
+	}
+}
+
+// transferInput handles the transfer and transfer_end messages of a connection
+func (t *TerminalSession) transferInput(a *attachment, msg TerminalMessage) error {
+	t.lock.Lock()
+	transfer := t.transfer
+	if transfer != nil && transfer.conn != a.conn.ID() {
+		t.lock.Unlock()
+		return fmt.Errorf("another connection is transferring files")
+	}
+	if msg.Op == "transfer_end" {
+		t.endTransferLocked(msg.Data == "cancel", msg.Data)
+		t.lock.Unlock()
+		return nil
+	}
+	if transfer != nil {
+		transfer.lastData = time.Now()
+	}
+	t.lock.Unlock()
+
+	// also taken outside of transfer mode, zmodem.js sends "OO" after the end of an upload
+	data, err := base64.StdEncoding.DecodeString(msg.Data)
+	if err != nil {
+		return fmt.Errorf("can't decode transfer data: %v", err)
+	}
+	t.sendInput(data)
+	return nil
+}
@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFileTransferSplit(t *testing.T) {
+	// ZFIN hex header as sz and rz print it
+	const zfin = "**\x18B0800000000022d\r\n"
+	tests := []struct {
+		name      string
+		protocol  string
+		direction string
+		chunks    []string // output of the process, written one after the other
+		data      []string // transfer data expected from each chunk
+		rest      string   // output left after the transfer, from the last chunk
+		ended     bool
+	}{
+		{"trzsz never ends in the output", TransferTrzsz, TransferDownload,
+			[]string{"::TRZSZ:TRANSFER:S:1.1.0:0\r\n#DATA"}, []string{"::TRZSZ:TRANSFER:S:1.1.0:0\r\n#DATA"}, "", false},
+		{"zmodem data", TransferZmodem, TransferDownload,
+			[]string{"**\x18B0100000023be50\r\n"}, []string{"**\x18B0100000023be50\r\n"}, "", false},
+		{"download ends with OO", TransferZmodem, TransferDownload,
+			[]string{"data" + zfin + "OO$ "}, []string{"data" + zfin + "OO"}, "$ ", true},
+		{"OO in the next write", TransferZmodem, TransferDownload,
+			[]string{"data" + zfin, "OO$ "}, []string{"data" + zfin, "OO"}, "$ ", true},
+		{"upload ends after the ZFIN of rz", TransferZmodem, TransferUpload,
+			[]string{"data" + zfin + "$ "}, []string{"data" + zfin}, "$ ", true},
+		{"cancelled", TransferZmodem, TransferUpload,
+			[]string{"data\x18\x18\x18\x18\x18\x08\x08\x08\x08\x08$ "}, []string{"data\x18\x18\x18\x18\x18\x08\x08\x08\x08\x08"}, "$ ", true},
+	}
+	for _, tt := range tests {
+		f := &fileTransfer{protocol: tt.protocol, direction: tt.direction}
+		var rest []byte
+		var ended bool
+		for i, chunk := range tt.chunks {
+			var data []byte
+			data, rest, ended = f.split([]byte(chunk))
+			if string(data) != tt.data[i] {
+				t.Errorf("%s: chunk %d: data %q, want %q", tt.name, i, data, tt.data[i])
+			}
+			if ended && i < len(tt.chunks)-1 {
+				t.Errorf("%s: ended at chunk %d", tt.name, i)
+			}
+		}
+		if string(rest) != tt.rest || ended != tt.ended {
+			t.Errorf("%s: rest %q, ended %v, want %q, %v", tt.name, rest, ended, tt.rest, tt.ended)
+		}
+	}
+}
+
+// transferEnds returns the Data of the transfer_end messages sent to the connection
+func (s *testSockJSSession) transferEnds() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var ends []string
+	for _, msg := range s.sent {
+		if msg.Op == "transfer_end" {
+			ends = append(ends, msg.Data)
+		}
+	}
+	return ends
+}
+
+// a trzsz transfer has no end in the output, it must not outlive its connection or its data
+func TestTrzszTransferEnd(t *testing.T) {
+	sm := &SessionMap{Sessions: make(map[string]*TerminalSession)}
+	alice, bob := &Principal{Name: "alice"}, &Principal{Name: "bob"}
+	terminalSession := newTerminalSession("transfer-test", alice, Host{}, nil)
+	sm.Set(terminalSession.id, terminalSession)
+	defer sm.Close(terminalSession.id, TerminalExit{Reason: ExitProcessExited})
+
+	owner, watcher := newTestSockJSSession("owner"), newTestSockJSSession("watcher")
+	defer close(watcher.recv)
+	if _, _, err := sm.Bind(terminalSession.id, "", alice, newSockJSConn(owner, "127.0.0.1", TransportSockJS)); err != nil {
+		t.Fatal(err)
+	}
+	token, err := terminalSession.share(RoleReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sm.Bind(terminalSession.id, token, bob, newSockJSConn(watcher, "127.0.0.1", TransportSockJS)); err != nil {
+		t.Fatal(err)
+	}
+	transferring := func() bool {
+		terminalSession.lock.Lock()
+		defer terminalSession.lock.Unlock()
+		return terminalSession.transfer != nil
+	}
+	write := func(p string) {
+		if _, err := terminalSession.Write([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// there is no process, its stdin goes nowhere
+	go func() {
+		for {
+			select {
+			case <-terminalSession.input:
+			case <-terminalSession.done:
+				return
+			}
+		}
+	}()
+	idle := func() {
+		terminalSession.lock.Lock()
+		defer terminalSession.lock.Unlock()
+		terminalSession.transfer.lastData = time.Now().Add(-2 * transferIdleTimeout)
+	}
+
+	write("::TRZSZ:TRANSFER:S:1.1.0:0\r\n")
+	if !transferring() {
+		t.Fatal("the transfer didn't start")
+	}
+	// data either way keeps the transfer going, the noop makes sure the pump took the data
+	idle()
+	owner.recv <- `{"op":"transfer","data":"I0FDVA=="}`
+	owner.recv <- `{"op":"noop"}`
+	terminalSession.endIdleTransfer(time.Now())
+	if !transferring() {
+		t.Fatal("a transfer with data from the browser was ended")
+	}
+	idle()
+	write("#DATA")
+	terminalSession.endIdleTransfer(time.Now())
+	if !transferring() {
+		t.Fatal("a transfer with data from the process was ended")
+	}
+	terminalSession.endIdleTransfer(time.Now().Add(2 * transferIdleTimeout))
+	if transferring() {
+		t.Fatal("an idle transfer wasn't ended")
+	}
+	if ends := owner.transferEnds(); len(ends) != 1 || ends[0] != "timeout" {
+		t.Errorf("got transfer ends %q, want a timeout", ends)
+	}
+	write("$ ")
+	if got := watcher.stdout(); got != "$ " {
+		t.Errorf("the watcher got %q after the transfer, want the prompt", got)
+	}
+
+	write("::TRZSZ:TRANSFER:R:1.1.0:0\r\n")
+	if !transferring() {
+		t.Fatal("the second transfer didn't start")
+	}
+	close(owner.recv)
+	waitFor(t, "the transfer to end with its connection", func() bool { return !transferring() })
+	write("$ ")
+	if got := watcher.stdout(); got != "$ $ " {
+		t.Errorf("the watcher got %q after the connection was lost, want the prompt", got)
+	}
+}
@@ -0,0 +1,253 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"gopkg.in/igm/sockjs-go.v2/sockjs"
+)
+
+// terminalConn is a browser connection attached to a terminal, SockJS or native WebSocket
+type terminalConn interface {
+	// ID identifies the connection among the attachments of a terminal
+	ID() string
+	// SendStdout sends output of the process
+	SendStdout(p []byte) error
+	// SendMessage sends a control message
+	SendMessage(msg TerminalMessage) error
+	// Recv blocks until the next message, stdin arrives as a "stdin" message. Malformed
+	// messages are logged and skipped, an error means the connection is gone.
+	Recv() (TerminalMessage, error)
+	// Close closes the connection telling the browser why
+	Close(status uint32, reason string) error
+	// setEncoding applies the Encoding requested by the bind or replay message
+	setEncoding(encoding string) error
+	// Transport is TransportWebSocket, or TransportSockJS followed by the SockJS transport
+	// like "sockjs/xhr_streaming"
+	Transport() string
+	// ClientIP is the address of the browser that opened the connection
+	ClientIP() string
+}
+
+// Transports of the connections
+const (
+	TransportSockJS    = "sockjs"
+	TransportWebSocket = "websocket"
+)
+
+// Data encodings of stdin and stdout messages
+const (
+	EncodingUTF8   = "utf8"
+	EncodingBase64 = "base64"
+)
+
+// sockJSConn carries every message as a JSON TerminalMessage in a SockJS text frame. The Data of
+// stdin and stdout is either text, with multi-byte characters split between two writes joined
+// again, or base64 of the raw bytes.
+type sockJSConn struct {
+	sockjs.Session
+	clientIP  string
+	transport string
+	lock      sync.Mutex // guards the fields below
+	encoding  string
+	stdout    utf8Joiner
+}
+
+func newSockJSConn(session sockjs.Session, clientIP, transport string) *sockJSConn {
+	return &sockJSConn{Session: session, clientIP: clientIP, transport: transport, encoding: EncodingUTF8}
+}
+
+// sockJSTransport names the SockJS transport of a request, the last element of
+// <prefix>/<server>/<session>/<transport>
+func sockJSTransport(urlPath string) string {
+	return TransportSockJS + "/" + path.Base(urlPath)
+}
+
+func (c *sockJSConn) Transport() string {
+	return c.transport
+}
+
+func (c *sockJSConn) ClientIP() string {
+	return c.clientIP
+}
+
+func (c *sockJSConn) setEncoding(encoding string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch encoding {
+	case "", EncodingUTF8:
+		c.encoding = EncodingUTF8
+	case EncodingBase64:
+		c.encoding = EncodingBase64
+	default:
+		return fmt.Errorf("unknown encoding '%s', expected %s or %s", encoding, EncodingUTF8, EncodingBase64)
+	}
+	return nil
+}
+
+func (c *sockJSConn) SendStdout(p []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.encoding == EncodingBase64 {
+		return c.send(TerminalMessage{Op: "stdout", Data: base64.StdEncoding.EncodeToString(p)})
+	}
+	if p = c.stdout.Join(p); len(p) == 0 {
+		return nil
+	}
+	return c.send(TerminalMessage{Op: "stdout", Data: string(p)})
+}
+
+func (c *sockJSConn) SendMessage(msg TerminalMessage) error {
+	return c.send(msg)
+}
+
+func (c *sockJSConn) send(msg TerminalMessage) error {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.Send(string(buf))
+}
+
+func (c *sockJSConn) Recv() (TerminalMessage, error) {
+	for {
+		m, err := c.Session.Recv()
+		if err != nil {
+			return TerminalMessage{}, err
+		}
+		var msg TerminalMessage
+		if err := json.Unmarshal([]byte(m), &msg); err != nil {
+			log.Printf("sockjs: can't UnMarshal (%v): %s", err, m)
+			continue
+		}
+		c.lock.Lock()
+		encoding := c.encoding
+		c.lock.Unlock()
+		if msg.Op == "stdin" && encoding == EncodingBase64 {
+			data, err := base64.StdEncoding.DecodeString(msg.Data)
+			if err != nil {
+				log.Printf("sockjs: can't decode base64 stdin: %v", err)
+				continue
+			}
+			msg.Data = string(data)
+		}
+		return msg, nil
+	}
+}
+
+const (
+	// webSocketWriteTimeout drops a connection that can't keep up instead of blocking the terminal
+	webSocketWriteTimeout = 10 * time.Second
+	// webSocketMaxMessage bounds a single frame from the browser, big enough for a large paste
+	webSocketMaxMessage = 1 << 20
+	// webSocketCloseBase is added to the SockJS close status, 4000-4999 are private close codes
+	webSocketCloseBase = 4000
+	// webSocketMaxReason is the room left for the reason in a close frame
+	webSocketMaxReason = 123
+)
+
+var webSocketUpgrader = websocket.Upgrader{ReadBufferSize: 4096, WriteBufferSize: 32 * 1024}
+
+// webSocketConn sends stdout and receives stdin as binary frames, control messages are JSON
+// TerminalMessages in text frames
+type webSocketConn struct {
+	id       string
+	clientIP string
+	conn     *websocket.Conn
+	lock     sync.Mutex // gorilla/websocket allows a single concurrent writer
+}
+
+func (c *webSocketConn) ID() string {
+	return c.id
+}
+
+func (c *webSocketConn) Transport() string {
+	return TransportWebSocket
+}
+
+func (c *webSocketConn) ClientIP() string {
+	return c.clientIP
+}
+
+// setEncoding accepts any encoding, stdin and stdout are binary frames of raw bytes anyway
+func (c *webSocketConn) setEncoding(encoding string) error {
+	return nil
+}
+
+func (c *webSocketConn) write(messageType int, data []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+	return c.conn.WriteMessage(messageType, data)
+}
+
+func (c *webSocketConn) SendStdout(p []byte) error {
+	return c.write(websocket.BinaryMessage, p)
+}
+
+func (c *webSocketConn) SendMessage(msg TerminalMessage) error {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.write(websocket.TextMessage, buf)
+}
+
+func (c *webSocketConn) Recv() (TerminalMessage, error) {
+	for {
+		messageType, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return TerminalMessage{}, err
+		}
+		if messageType == websocket.BinaryMessage {
+			return TerminalMessage{Op: "stdin", Data: string(data)}, nil
+		}
+		var msg TerminalMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Printf("websocket: can't UnMarshal (%v): %s", err, data)
+			continue
+		}
+		return msg, nil
+	}
+}
+
+// Close sends a close frame with code 4000 + status, the reason is cut to fit the frame
+func (c *webSocketConn) Close(status uint32, reason string) error {
+	if len(reason) > webSocketMaxReason {
+		reason = reason[:webSocketMaxReason]
+		for !utf8.ValidString(reason) {
+			reason = reason[:len(reason)-1]
+		}
+	}
+	msg := websocket.FormatCloseMessage(webSocketCloseBase+int(status), reason)
+	_ = c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	return c.conn.Close()
+}
+
+// HandleWebSocket serves the native WebSocket endpoint, stdin and stdout are binary frames and the
+// other ops JSON text frames
+func HandleWebSocket(context *gin.Context) {
+	principal := CurrentPrincipal(context)
+	id, err := genTerminalSessionId()
+	if err != nil {
+		context.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	conn, err := webSocketUpgrader.Upgrade(context.Writer, context.Request, nil)
+	if err != nil {
+		// Upgrade has already answered the request
+		log.Printf("websocket: %v", err)
+		return
+	}
+	conn.SetReadLimit(webSocketMaxMessage)
+	handleTerminalSession(&webSocketConn{id: id, clientIP: context.ClientIP(), conn: conn}, principal)
+}
@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestWebSocketConn connects a client to a webSocketConn served by httptest
+func newTestWebSocketConn(t *testing.T) (*webSocketConn, *websocket.Conn, func()) {
+	conns := make(chan *webSocketConn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := webSocketUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- &webSocketConn{id: "ws-test", conn: conn}
+	}))
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	conn := <-conns
+	return conn, client, func() {
+		_ = client.Close()
+		_ = conn.conn.Close()
+		server.Close()
+	}
+}
+
+func TestWebSocketConnFraming(t *testing.T) {
+	conn, client, cleanup := newTestWebSocketConn(t)
+	defer cleanup()
+
+	if err := conn.SendStdout([]byte("héllo\x1b[0m")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SendMessage(TerminalMessage{Op: "toast", Data: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if messageType, data, err := client.ReadMessage(); err != nil || messageType != websocket.BinaryMessage || string(data) != "héllo\x1b[0m" {
+		t.Errorf("stdout: got type %d %q, %v, want a binary frame", messageType, data, err)
+	}
+	var msg TerminalMessage
+	if err := client.ReadJSON(&msg); err != nil || msg.Op != "toast" || msg.Data != "hi" {
+		t.Errorf("toast: got %+v, %v", msg, err)
+	}
+
+	for _, frame := range []struct {
+		messageType int
+		data        string
+	}{
+		{websocket.BinaryMessage, "ls -l\r"},
+		{websocket.TextMessage, "not json"},
+		{websocket.TextMessage, `{"op":"resize","cols":120,"rows":40}`},
+	} {
+		if err := client.WriteMessage(frame.messageType, []byte(frame.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if msg, err := conn.Recv(); err != nil || msg.Op != "stdin" || msg.Data != "ls -l\r" {
+		t.Errorf("binary frame: got %+v, %v, want stdin", msg, err)
+	}
+	// the malformed text frame is skipped
+	if msg, err := conn.Recv(); err != nil || msg.Op != "resize" || msg.Cols != 120 || msg.Rows != 40 {
+		t.Errorf("text frame: got %+v, %v, want the resize", msg, err)
+	}
+
+	_ = client.Close()
+	if _, err := conn.Recv(); err == nil {
+		t.Error("Recv didn't fail after the browser went away")
+	}
+}
+
+func TestWebSocketConnClose(t *testing.T) {
+	tests := []struct {
+		status uint32
+		reason string
+	}{
+		{1, "Process exited"},
+		{2, strings.Repeat("界", 50)},
+	}
+	for _, tt := range tests {
+		conn, client, cleanup := newTestWebSocketConn(t)
+		if err := conn.Close(tt.status, tt.reason); err != nil {
+			t.Error(err)
+		}
+		_, _, err := client.ReadMessage()
+		closeErr, ok := err.(*websocket.CloseError)
+		if !ok {
+			t.Errorf("status %d: got %v, want a close frame", tt.status, err)
+			cleanup()
+			continue
+		}
+		if closeErr.Code != webSocketCloseBase+int(tt.status) {
+			t.Errorf("status %d: got close code %d", tt.status, closeErr.Code)
+		}
+		if len(closeErr.Text) > webSocketMaxReason || !utf8.ValidString(closeErr.Text) || !strings.HasPrefix(tt.reason, closeErr.Text) {
+			t.Errorf("status %d: got reason %q, want a valid prefix of at most %d bytes", tt.status, closeErr.Text, webSocketMaxReason)
+		}
+		cleanup()
+	}
+}
+
+func TestSockJSConnFraming(t *testing.T) {
+	session := newTestSockJSSession("sockjs-test")
+	conn := newSockJSConn(session, "127.0.0.1", TransportSockJS)
+	if err := conn.SendStdout([]byte("héllo")); err != nil {
+		t.Fatal(err)
+	}
+	if len(session.sent) != 1 || session.sent[0].Op != "stdout" || session.sent[0].Data != "héllo" {
+		t.Errorf("got %+v, want a JSON stdout message", session.sent)
+	}
+
+	go func() {
+		session.recv <- "not json"
+		session.recv <- `{"op":"stdin","data":"ls\r"}`
+		close(session.recv)
+	}()
+	if msg, err := conn.Recv(); err != nil || msg.Op != "stdin" || msg.Data != "ls\r" {
+		t.Errorf("got %+v, %v, want the stdin message after the malformed one", msg, err)
+	}
+	if _, err := conn.Recv(); err == nil {
+		t.Error("Recv didn't fail after the connection was lost")
+	}
+}
+
+func TestSockJSConnEncoding(t *testing.T) {
+	session := newTestSockJSSession("sockjs-test")
+	conn := newSockJSConn(session, "127.0.0.1", TransportSockJS)
+	if err := conn.setEncoding("latin1"); err == nil {
+		t.Error("accepted an unknown encoding")
+	}
+
+	// in text mode a character split between two writes is sent once it is complete
+	for _, p := range [][]byte{[]byte("a\xe4\xb8"), []byte("\x96b")} {
+		if err := conn.SendStdout(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := session.stdout(); got != "a世b" {
+		t.Errorf("utf8: got %q, want a世b", got)
+	}
+
+	if err := conn.setEncoding(EncodingBase64); err != nil {
+		t.Fatal(err)
+	}
+	session.sent = nil
+	if err := conn.SendStdout([]byte("\xe4\xb8")); err != nil {
+		t.Fatal(err)
+	}
+	if got := session.stdout(); got != base64.StdEncoding.EncodeToString([]byte("\xe4\xb8")) {
+		t.Errorf("base64: got %q, want the raw bytes", got)
+	}
+
+	go func() {
+		session.recv <- `{"op":"stdin","data":"not base64!"}`
+		session.recv <- `{"op":"stdin","data":"` + base64.StdEncoding.EncodeToString([]byte("\x03")) + `"}`
+		close(session.recv)
+	}()
+	if msg, err := conn.Recv(); err != nil || msg.Data != "\x03" {
+		t.Errorf("got %+v, %v, want the decoded stdin after the bad one", msg, err)
+	}
+}
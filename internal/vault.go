@@ -0,0 +1,294 @@
+package internal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credential is a login stored in the vault, its secrets never leave the server
+type Credential struct {
+	Id         string    `json:"id"`
+	Name       string    `json:"name"`
+	Owner      string    `json:"owner"`
+	Username   string    `json:"username"`
+	Password   string    `json:"password,omitempty"`
+	PrivateKey string    `json:"privateKey,omitempty"`
+	Passphrase string    `json:"passphrase,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// CredentialInfo is what the API returns for a credential
+type CredentialInfo struct {
+	Id            string    `json:"id"`
+	Name          string    `json:"name"`
+	Owner         string    `json:"owner"`
+	Username      string    `json:"username"`
+	HasPassword   bool      `json:"hasPassword"`
+	HasPrivateKey bool      `json:"hasPrivateKey"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+func (c *Credential) Info() CredentialInfo {
+	return CredentialInfo{
+		Id:            c.Id,
+		Name:          c.Name,
+		Owner:         c.Owner,
+		Username:      c.Username,
+		HasPassword:   c.Password != "",
+		HasPrivateKey: c.PrivateKey != "",
+		CreatedAt:     c.CreatedAt,
+		UpdatedAt:     c.UpdatedAt,
+	}
+}
+
+// vaultFile is the on-disk format, data is the AES-GCM sealed JSON list of credentials
+type vaultFile struct {
+	Version int    `json:"version"`
+	Nonce   string `json:"nonce"`
+	Data    string `json:"data"`
+}
+
+// Vault keeps credentials encrypted at rest with a master key
+type Vault struct {
+	path        string
+	aead        cipher.AEAD
+	lock        sync.RWMutex
+	credentials map[string]*Credential
+}
+
+var vault *Vault
+
+var errVaultDisabled = errors.New("the credential vault is not configured, start the server with a master key")
+
+// ParseMasterKey accepts a 32 byte key as raw bytes, hex or base64
+func ParseMasterKey(key []byte) ([]byte, error) {
+	if len(key) == 32 {
+		return key, nil
+	}
+	text := strings.TrimSpace(string(key))
+	if decoded, err := hex.DecodeString(text); err == nil && len(decoded) == 32 {
+		return decoded, nil
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(text); err == nil && len(decoded) == 32 {
+		return decoded, nil
+	}
+	return nil, errors.New("the master key must be 32 bytes, raw, hex or base64 encoded")
+}
+
+// InitVault is called from main to open the vault, the file is created on the first save. An empty
+// masterKey disables the vault.
+func InitVault(path string, masterKey []byte) error {
+	if len(masterKey) == 0 {
+		return nil
+	}
+	key, err := ParseMasterKey(masterKey)
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	v := &Vault{path: path, aead: aead, credentials: make(map[string]*Credential)}
+	if err := v.load(); err != nil {
+		return err
+	}
+	vault = v
+	return nil
+}
+
+func (v *Vault) load() error {
+	content, err := ioutil.ReadFile(v.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var f vaultFile
+	if err := json.Unmarshal(content, &f); err != nil {
+		return fmt.Errorf("%s: %v", v.path, err)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(f.Nonce)
+	if err != nil {
+		return fmt.Errorf("%s: %v", v.path, err)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(f.Data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", v.path, err)
+	}
+	plain, err := v.aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return fmt.Errorf("%s: can't decrypt, wrong master key? (%v)", v.path, err)
+	}
+	var credentials []*Credential
+	if err := json.Unmarshal(plain, &credentials); err != nil {
+		return fmt.Errorf("%s: %v", v.path, err)
+	}
+	for _, c := range credentials {
+		v.credentials[c.Id] = c
+	}
+	return nil
+}
+
+// save seals every credential with a fresh nonce and replaces the file, the caller must hold the lock
+func (v *Vault) save() error {
+	credentials := make([]*Credential, 0, len(v.credentials))
+	for _, c := range v.credentials {
+		credentials = append(credentials, c)
+	}
+	plain, err := json.Marshal(credentials)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, v.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	content, err := json.Marshal(vaultFile{
+		Version: 1,
+		Nonce:   base64.StdEncoding.EncodeToString(nonce),
+		Data:    base64.StdEncoding.EncodeToString(v.aead.Seal(nil, nonce, plain, nil)),
+	})
+	if err != nil {
+		return err
+	}
+	tmp := v.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, v.path)
+}
+
+// List returns the credentials principal may use, sorted by name
+func (v *Vault) List(principal *Principal) []CredentialInfo {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	infos := make([]CredentialInfo, 0)
+	for _, c := range v.credentials {
+		if principal.allowed(c.Owner) {
+			infos = append(infos, c.Info())
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// Get returns a copy of a credential principal may use
+func (v *Vault) Get(id string, principal *Principal) (*Credential, error) {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	c, ok := v.credentials[id]
+	if !ok || !principal.allowed(c.Owner) {
+		return nil, fmt.Errorf("can't find credential '%s'", id)
+	}
+	credential := *c
+	return &credential, nil
+}
+
+// Create stores a new credential owned by principal
+func (v *Vault) Create(c Credential, principal *Principal) (*Credential, error) {
+	id, err := genTerminalSessionId()
+	if err != nil {
+		return nil, err
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	now := time.Now()
+	c.Id, c.Owner, c.CreatedAt, c.UpdatedAt = id, principal.Name, now, now
+	v.credentials[id] = &c
+	if err := v.save(); err != nil {
+		delete(v.credentials, id)
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Update replaces the fields of a credential, empty secrets keep the stored ones
+func (v *Vault) Update(id string, update Credential, principal *Principal) (*Credential, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	old, ok := v.credentials[id]
+	if !ok || !principal.allowed(old.Owner) {
+		return nil, fmt.Errorf("can't find credential '%s'", id)
+	}
+	c := *old
+	if update.Name != "" {
+		c.Name = update.Name
+	}
+	if update.Username != "" {
+		c.Username = update.Username
+	}
+	if update.Password != "" {
+		c.Password = update.Password
+	}
+	if update.PrivateKey != "" {
+		c.PrivateKey, c.Passphrase = update.PrivateKey, update.Passphrase
+	}
+	c.UpdatedAt = time.Now()
+	v.credentials[id] = &c
+	if err := v.save(); err != nil {
+		v.credentials[id] = old
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Delete removes a credential
+func (v *Vault) Delete(id string, principal *Principal) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	old, ok := v.credentials[id]
+	if !ok || !principal.allowed(old.Owner) {
+		return fmt.Errorf("can't find credential '%s'", id)
+	}
+	delete(v.credentials, id)
+	if err := v.save(); err != nil {
+		v.credentials[id] = old
+		return err
+	}
+	return nil
+}
+
+// resolveCredentials fills the login of host and of its jump hosts from the vault when they
+// reference a stored credential
+func resolveCredentials(host *Host, principal *Principal) error {
+	if host.CredentialId != "" {
+		if vault == nil {
+			return errVaultDisabled
+		}
+		c, err := vault.Get(host.CredentialId, principal)
+		if err != nil {
+			return err
+		}
+		if host.Username == "" {
+			host.Username = c.Username
+		}
+		host.Password, host.PrivateKey, host.Passphrase = c.Password, c.PrivateKey, c.Passphrase
+	}
+	for i := range host.Jumps {
+		if err := resolveCredentials(&host.Jumps[i], principal); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestVault(t *testing.T, path string, key []byte) *Vault {
+	defer func(old *Vault) { vault = old }(vault)
+	if err := InitVault(path, key); err != nil {
+		t.Fatal(err)
+	}
+	return vault
+}
+
+func TestVaultSealOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "vault.json")
+	key := bytes.Repeat([]byte{7}, 32)
+
+	alice := &Principal{Name: "alice"}
+	c, err := openTestVault(t, path, key).Create(Credential{Name: "prod", Username: "deploy", Password: "s3cret"}, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(content, []byte("s3cret")) || bytes.Contains(content, []byte("deploy")) {
+		t.Fatal("the vault file contains the credential in clear text")
+	}
+
+	reopened := openTestVault(t, path, []byte(base64.StdEncoding.EncodeToString(key)))
+	if got, err := reopened.Get(c.Id, alice); err != nil || got.Password != "s3cret" || got.Username != "deploy" {
+		t.Fatalf("after reopening got %+v, %v", got, err)
+	}
+
+	if err := InitVault(path, bytes.Repeat([]byte{8}, 32)); err == nil {
+		t.Error("opened the vault with the wrong master key")
+	}
+
+	var f vaultFile
+	if err := json.Unmarshal(content, &f); err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ := base64.StdEncoding.DecodeString(f.Data)
+	sealed[len(sealed)/2] ^= 1
+	f.Data = base64.StdEncoding.EncodeToString(sealed)
+	tampered, _ := json.Marshal(f)
+	if err := ioutil.WriteFile(path, tampered, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitVault(path, key); err == nil {
+		t.Error("opened a vault file that was changed on disk")
+	}
+}
+
+func TestParseMasterKey(t *testing.T) {
+	raw := bytes.Repeat([]byte{1}, 32)
+	for _, key := range [][]byte{raw, []byte("0101010101010101010101010101010101010101010101010101010101010101\n"),
+		[]byte(base64.StdEncoding.EncodeToString(raw))} {
+		if got, err := ParseMasterKey(key); err != nil || !bytes.Equal(got, raw) {
+			t.Errorf("%q: got %x, %v", key, got, err)
+		}
+	}
+	for _, key := range [][]byte{[]byte("short"), bytes.Repeat([]byte{1}, 31), []byte("0101")} {
+		if _, err := ParseMasterKey(key); err == nil {
+			t.Errorf("%q: accepted", key)
+		}
+	}
+}
+
+func TestVaultOwner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	v := openTestVault(t, filepath.Join(dir, "vault.json"), bytes.Repeat([]byte{7}, 32))
+
+	alice, bob, admin := &Principal{Name: "alice"}, &Principal{Name: "bob"}, &Principal{Name: "root", Admin: true}
+	c, err := v.Create(Credential{Name: "prod", Username: "deploy", Password: "s3cret"}, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Owner != "alice" {
+		t.Errorf("got owner %q, want alice", c.Owner)
+	}
+
+	if infos := v.List(bob); len(infos) != 0 {
+		t.Errorf("bob lists %+v", infos)
+	}
+	if _, err := v.Get(c.Id, bob); err == nil {
+		t.Error("bob can read the credential of alice")
+	}
+	if _, err := v.Update(c.Id, Credential{Password: "mine"}, bob); err == nil {
+		t.Error("bob can change the credential of alice")
+	}
+	if err := v.Delete(c.Id, bob); err == nil {
+		t.Error("bob can delete the credential of alice")
+	}
+	defer func(old *Vault) { vault = old }(vault)
+	vault = v
+	host := Host{Ip: "10.0.0.1", CredentialId: c.Id}
+	if err := resolveCredentials(&host, bob); err == nil || host.Password != "" {
+		t.Error("bob can connect with the credential of alice")
+	}
+	jump := Host{Ip: "10.0.0.2", Jumps: []Host{{Ip: "10.0.0.1", CredentialId: c.Id}}}
+	if err := resolveCredentials(&jump, bob); err == nil {
+		t.Error("bob can use the credential of alice for a jump host")
+	}
+
+	if err := resolveCredentials(&host, alice); err != nil || host.Username != "deploy" || host.Password != "s3cret" {
+		t.Errorf("alice got %+v, %v", host, err)
+	}
+	if infos := v.List(admin); len(infos) != 1 || !infos[0].HasPassword {
+		t.Errorf("admin lists %+v", infos)
+	}
+	updated, err := v.Update(c.Id, Credential{Name: "production"}, admin)
+	if err != nil || updated.Password != "s3cret" || updated.Owner != "alice" {
+		t.Errorf("admin update got %+v, %v, want the password and owner kept", updated, err)
+	}
+	if err := v.Delete(c.Id, alice); err != nil {
+		t.Error(err)
+	}
+}
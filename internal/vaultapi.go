@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CredentialRequest is the body of create and update, secrets are write only
+type CredentialRequest struct {
+	Name       string `json:"name"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	PrivateKey string `json:"privateKey"`
+	Passphrase string `json:"passphrase"`
+}
+
+func (r CredentialRequest) credential() Credential {
+	return Credential{
+		Name:       r.Name,
+		Username:   r.Username,
+		Password:   r.Password,
+		PrivateKey: r.PrivateKey,
+		Passphrase: r.Passphrase,
+	}
+}
+
+// HandleListCredentials lists the credentials of the principal, without their secrets
+func HandleListCredentials(context *gin.Context) {
+	if vault == nil {
+		Fail(errVaultDisabled.Error(), context)
+		return
+	}
+	SuccessWithData(vault.List(CurrentPrincipal(context)), context)
+}
+
+func HandleGetCredential(context *gin.Context) {
+	if vault == nil {
+		Fail(errVaultDisabled.Error(), context)
+		return
+	}
+	c, err := vault.Get(context.Param("id"), CurrentPrincipal(context))
+	if err != nil {
+		Fail(err.Error(), context)
+		return
+	}
+	SuccessWithData(c.Info(), context)
+}
+
+// HandleCreateCredential stores a credential, it needs a password or a private key
+func HandleCreateCredential(context *gin.Context) {
+	var req CredentialRequest
+	if err := context.BindJSON(&req); err != nil || req.Name == "" || req.Username == "" ||
+		(req.Password == "" && req.PrivateKey == "") {
+		context.JSON(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	if vault == nil {
+		Fail(errVaultDisabled.Error(), context)
+		return
+	}
+	c, err := vault.Create(req.credential(), CurrentPrincipal(context))
+	if err != nil {
+		Fail(err.Error(), context)
+		return
+	}
+	SuccessWithData(c.Info(), context)
+}
+
+// HandleUpdateCredential changes a credential, empty fields are kept
+func HandleUpdateCredential(context *gin.Context) {
+	var req CredentialRequest
+	if err := context.BindJSON(&req); err != nil {
+		context.JSON(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	if vault == nil {
+		Fail(errVaultDisabled.Error(), context)
+		return
+	}
+	c, err := vault.Update(context.Param("id"), req.credential(), CurrentPrincipal(context))
+	if err != nil {
+		Fail(err.Error(), context)
+		return
+	}
+	SuccessWithData(c.Info(), context)
+}
+
+func HandleDeleteCredential(context *gin.Context) {
+	if vault == nil {
+		Fail(errVaultDisabled.Error(), context)
+		return
+	}
+	if err := vault.Delete(context.Param("id"), CurrentPrincipal(context)); err != nil {
+		Fail(err.Error(), context)
+		return
+	}
+	Success(context)
+}
@@ -9,16 +9,94 @@ import (
     "flag"
     "fmt"
     "github.com/gin-gonic/gin"
+    "io/ioutil"
     "net/http"
+    "os"
     "time"
     "web-terminal/internal"
 )
 
 func main() {
-    var port string
+    if len(os.Args) > 1 && os.Args[1] == "import" {
+        os.Exit(runImport(os.Args[2:]))
+    }
+
+    var (
+        port           string
+        knownHostsFile string
+        hostKeyMode    string
+        bindTimeout    time.Duration
+        idleTimeout    time.Duration
+        reconnectGrace time.Duration
+        authTokensFile string
+        jwtSecret      string
+        policyFile     string
+        vaultFile      string
+        vaultKeyFile   string
+        inventoryFile  string
+    )
     flag.StringVar(&port, "port", "8080", "the server port!")
+    flag.StringVar(&knownHostsFile, "known-hosts", "known_hosts", "the known_hosts file used to verify host keys")
+    flag.StringVar(&hostKeyMode, "host-key-mode", "tofu", "host key verification mode: tofu, strict or off")
+    flag.DurationVar(&bindTimeout, "bind-timeout", 30*time.Second, "how long a created terminal waits for the browser to connect")
+    flag.DurationVar(&idleTimeout, "idle-timeout", 30*time.Minute, "close terminals without any input or output for this long, 0 to disable")
+    flag.DurationVar(&reconnectGrace, "reconnect-grace", time.Minute, "how long a terminal survives a lost connection waiting for the browser to re-attach")
+    flag.IntVar(&internal.ScrollbackSize, "scrollback", internal.ScrollbackSize, "bytes of recent output replayed to a re-attached terminal")
+    flag.StringVar(&internal.RecordDir, "record-dir", "", "record every terminal as asciicast v2 into this directory, disabled when empty")
+    flag.Int64Var(&internal.RecordMaxSize, "record-max-size", internal.RecordMaxSize, "bytes after which a recording continues in a new file")
+    flag.StringVar(&authTokensFile, "auth-tokens", "", "file of static API tokens, one '<token> <principal> [admin]' per line")
+    flag.StringVar(&jwtSecret, "jwt-secret", os.Getenv("WEB_TERMINAL_JWT_SECRET"), "secret of HS256 signed JWT bearer tokens")
+    flag.StringVar(&policyFile, "target-policy", "", "JSON file restricting which hosts and ports terminals may connect to")
+    flag.StringVar(&vaultFile, "vault", "vault.json", "the encrypted credential vault")
+    flag.StringVar(&vaultKeyFile, "vault-key-file", "", "file holding the 32 byte vault master key, WEB_TERMINAL_MASTER_KEY is used when empty")
+    flag.StringVar(&inventoryFile, "inventory", "inventory.json", "the host inventory, disabled when empty")
+    flag.DurationVar(&internal.KeepaliveInterval, "keepalive-interval", internal.KeepaliveInterval, "probe every ssh connection this often, 0 to disable")
+    flag.IntVar(&internal.KeepaliveCountMax, "keepalive-count", internal.KeepaliveCountMax, "unanswered keepalives after which a connection is closed")
+    flag.BoolVar(&internal.AgentForAll, "ssh-agent-for-all", internal.AgentForAll, "let every principal log in with the keys of the server's ssh-agent, only administrators can by default")
+    flag.Parse()
     fmt.Println(port)
-    engine := gin.Default()
+
+    mode, err := internal.ParseHostKeyMode(hostKeyMode)
+    if err != nil {
+        panic(err)
+    }
+    if err := internal.InitKnownHosts(knownHostsFile, mode); err != nil {
+        panic(err)
+    }
+    if err := internal.InitTargetPolicy(policyFile); err != nil {
+        panic(err)
+    }
+    masterKey := []byte(os.Getenv("WEB_TERMINAL_MASTER_KEY"))
+    if vaultKeyFile != "" {
+        if masterKey, err = ioutil.ReadFile(vaultKeyFile); err != nil {
+            panic(err)
+        }
+    }
+    if err := internal.InitVault(vaultFile, masterKey); err != nil {
+        panic(err)
+    }
+    if err := internal.InitInventory(inventoryFile); err != nil {
+        panic(err)
+    }
+
+    if authTokensFile != "" {
+        authenticator, err := internal.NewStaticTokenAuthenticator(authTokensFile)
+        if err != nil {
+            panic(err)
+        }
+        internal.UseAuthenticator(authenticator)
+    }
+    if jwtSecret != "" {
+        internal.UseAuthenticator(internal.NewJWTAuthenticator(jwtSecret))
+    }
+    if !internal.AuthEnabled() {
+        fmt.Println("WARNING: no -auth-tokens or -jwt-secret given, the API is open to anyone who can reach it")
+    }
+
+    internal.StartSessionReaper(bindTimeout, reconnectGrace, idleTimeout)
+
+    engine := gin.New()
+    engine.Use(internal.HideAccessToken(), gin.Logger(), gin.Recovery())
     //engine.StaticFS("/swagger", http.Dir("swagger"))
     engine.Static("/static", "./static")
     initRouter(engine)
@@ -40,17 +118,65 @@ func main() {
 
 func initRouter(engine *gin.Engine)  {
     engine.GET("/hello", internal.HelloWord)
-    engine.POST("/v1/terminal", internal.HandleExecNodeShell)
-    engine.GET("/v1/sockjs/*any", func(context *gin.Context) {
-        handler := internal.CreateAttachHandler("/v1/sockjs")
-        handler.ServeHTTP(context.Writer, context.Request)
-    })
-    engine.POST("/v1/sockjs/*any", func(context *gin.Context) {
-        handler := internal.CreateAttachHandler("/v1/sockjs")
-        handler.ServeHTTP(context.Writer, context.Request)
-    })
-    engine.OPTIONS("/v1/sockjs/*any", func(context *gin.Context) {
-        handler := internal.CreateAttachHandler("/v1/sockjs")
-        handler.ServeHTTP(context.Writer, context.Request)
-    })
+    engine.GET("/metrics", internal.HandleMetrics)
+
+    v1 := engine.Group("/v1", internal.Authenticate())
+    v1.POST("/terminal", internal.HandleExecNodeShell)
+    v1.POST("/terminal/:id/share", internal.HandleShareTerminal)
+    v1.GET("/terminal/:id/forwards", internal.HandleListForwards)
+    v1.POST("/terminal/:id/forwards", internal.HandleCreateForward)
+    v1.DELETE("/terminal/:id/forwards/:forward", internal.HandleDeleteForward)
+    v1.GET("/terminal/:id/tunnel", internal.HandleForwardTunnel)
+    v1.GET("/recordings", internal.HandleListRecordings)
+    v1.GET("/recordings/:id", internal.HandleGetRecording)
+    v1.GET("/recordings/:id/download", internal.HandleDownloadRecording)
+    v1.GET("/credentials", internal.HandleListCredentials)
+    v1.POST("/credentials", internal.HandleCreateCredential)
+    v1.GET("/credentials/:id", internal.HandleGetCredential)
+    v1.PUT("/credentials/:id", internal.HandleUpdateCredential)
+    v1.DELETE("/credentials/:id", internal.HandleDeleteCredential)
+    v1.GET("/hosts", internal.HandleListHosts)
+    v1.GET("/hosts/:id", internal.HandleGetHost)
+    v1.GET("/groups", internal.HandleListHostGroups)
+    v1.GET("/ws", internal.HandleWebSocket)
+    v1.GET("/sockjs/*any", handleSockJS)
+    v1.POST("/sockjs/*any", handleSockJS)
+    v1.OPTIONS("/sockjs/*any", handleSockJS)
+
+    forward := engine.Group("/v1/forward", internal.AuthenticateForward())
+    forward.Any("/:forward", internal.HandleForwardProxy)
+    forward.Any("/:forward/*path", internal.HandleForwardProxy)
+
+    sessionSFTP := v1.Group("/terminal/:id/sftp", internal.SessionSFTP())
+    hostSFTP := v1.Group("/hosts/:id/sftp", internal.HostSFTP())
+    for _, sftp := range []*gin.RouterGroup{sessionSFTP, hostSFTP} {
+        sftp.GET("/list", internal.HandleSFTPList)
+        sftp.GET("/stat", internal.HandleSFTPStat)
+        sftp.GET("/download", internal.HandleSFTPDownload)
+        sftp.POST("/upload", internal.HandleSFTPUpload)
+        sftp.POST("/mkdir", internal.HandleSFTPMkdir)
+        sftp.POST("/rename", internal.HandleSFTPRename)
+        sftp.POST("/chmod", internal.HandleSFTPChmod)
+        sftp.DELETE("", internal.HandleSFTPDelete)
+    }
+
+    admin := v1.Group("", internal.RequireAdmin())
+    admin.GET("/knownhosts", internal.HandleListKnownHosts)
+    admin.POST("/knownhosts/approve", internal.HandleApproveKnownHost)
+    admin.DELETE("/knownhosts", internal.HandleRevokeKnownHost)
+    admin.POST("/terminal/:id/signal", internal.HandleSignalTerminal)
+    admin.GET("/sessions", internal.HandleListSessions)
+    admin.GET("/sessions/:id", internal.HandleGetSession)
+    admin.DELETE("/sessions/:id", internal.HandleKillSession)
+    admin.POST("/hosts", internal.HandleSaveHost)
+    admin.PUT("/hosts/:id", internal.HandleSaveHost)
+    admin.DELETE("/hosts/:id", internal.HandleDeleteHost)
+    admin.PUT("/groups/:name", internal.HandleSaveHostGroup)
+    admin.DELETE("/groups/:name", internal.HandleDeleteHostGroup)
+    admin.POST("/inventory/import", internal.HandleImportInventory)
+}
+
+func handleSockJS(context *gin.Context) {
+    handler := internal.CreateAttachHandler("/v1/sockjs", internal.CurrentPrincipal(context), context.ClientIP())
+    handler.ServeHTTP(context.Writer, context.Request)
 }
\ No newline at end of file